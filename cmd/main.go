@@ -2,23 +2,44 @@ package main
 
 import (
 	"net/http"
+	"os"
 
 	internal "github.com/rajasoun/traefik-forward-auth/internal"
 )
 
 // Main
 func main() {
+	// Run any subcommand
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check-config":
+			os.Exit(internal.CheckConfigCommand(os.Args[2:], os.Stdout))
+		case "explain":
+			os.Exit(internal.ExplainCommand(os.Args[2:], os.Stdout))
+		case "cookie":
+			os.Exit(internal.CookieCommand(os.Args[2:], os.Stdout))
+		case "secrets":
+			os.Exit(internal.SecretsCommand(os.Args[2:], os.Stdin, os.Stdout))
+		}
+	}
+
 	// Parse options
-	config := internal.NewGlobalConfig()
+	config := internal.NewConfigFromArgs()
 
 	// Setup logger
-	log := internal.NewDefaultLogger()
+	log := internal.NewDefaultLogger(config.LogOptions())
 
 	// Perform config validation
 	config.Validate()
 
 	// Build server
-	server := internal.NewServer()
+	server, err := internal.NewServer(config, log)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Reload config on changes
+	go internal.NewReloaderFromArgs(server).Run(nil)
 
 	// Attach router to default server
 	http.HandleFunc("/", server.RootHandler)
@@ -0,0 +1,139 @@
+// Package forwardauth provides traefik forward auth as net/http middleware,
+// for services which want to authenticate requests in-process rather than
+// behind a separate forward auth container
+package forwardauth
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	tfa "github.com/rajasoun/traefik-forward-auth/internal"
+	"github.com/rajasoun/traefik-forward-auth/internal/provider"
+	"github.com/sirupsen/logrus"
+)
+
+// Config holds the forward auth config, the same options as the server,
+// create it with ParseConfig
+type Config struct {
+	config *tfa.Config
+}
+
+// User is the authenticated user
+type User = provider.User
+
+// Rule decides how the requests it matches are handled, each field is the
+// rule.<name>.<param> option of the same name, and is unset when empty
+type Rule struct {
+	Action                  string
+	Rule                    string
+	Provider                string
+	Providers               []string
+	Whitelist               []string
+	Domains                 []string
+	UnauthenticatedResponse string
+	Priority                int
+	Policy                  string
+	Webhook                 string
+	WebhookFailOpen         bool
+	MaxAuthAge              int
+	ACR                     []string
+	AMR                     []string
+}
+
+// args returns the rule as rule.<name>.<param> options
+func (r Rule) args(name string) []string {
+	var args []string
+	add := func(param, val string) {
+		if val != "" {
+			args = append(args, "--rule."+name+"."+param+"="+val)
+		}
+	}
+
+	add("action", r.Action)
+	add("rule", r.Rule)
+	add("provider", r.Provider)
+	add("providers", strings.Join(r.Providers, ","))
+	add("whitelist", strings.Join(r.Whitelist, ","))
+	add("domains", strings.Join(r.Domains, ","))
+	add("unauthenticated-response", r.UnauthenticatedResponse)
+	if r.Priority != 0 {
+		add("priority", strconv.Itoa(r.Priority))
+	}
+	add("policy", r.Policy)
+	add("webhook", r.Webhook)
+	if r.WebhookFailOpen {
+		add("webhook-fail-open", "true")
+	}
+	if r.MaxAuthAge != 0 {
+		add("max-auth-age", strconv.Itoa(r.MaxAuthAge))
+	}
+	add("acr", strings.Join(r.ACR, ","))
+	add("amr", strings.Join(r.AMR, ","))
+	return args
+}
+
+// Option adds to the config parsed by ParseConfig
+type Option func(args []string) []string
+
+// WithRule adds the rule with the given name, taking precedence over a rule
+// of that name given by the args
+func WithRule(name string, rule Rule) Option {
+	return func(args []string) []string {
+		return append(args, rule.args(name)...)
+	}
+}
+
+// ParseConfig parses and validates command line style args, such as
+// "--secret=abc" or "--config=/path/to/config.ini", and any options into a
+// config
+func ParseConfig(args []string, opts ...Option) (*Config, error) {
+	args = append([]string{}, args...)
+	for _, opt := range opts {
+		args = opt(args)
+	}
+
+	config, err := tfa.ParseConfig(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Config{config: config}, nil
+}
+
+// Middleware authenticates requests before passing them to the wrapped
+// handler
+type Middleware struct {
+	server *tfa.Server
+}
+
+// New creates middleware for the given config, logging to logger or the
+// default logger if nil
+func New(config *Config, logger *logrus.Logger) (*Middleware, error) {
+	server, err := tfa.NewServer(config.config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Middleware{server: server}, nil
+}
+
+// Wrap returns a handler which authenticates requests before passing them to
+// next, with the auth response's headers, such as X-Forwarded-User and those
+// set by webhooks. Requests to the callback and logout paths are handled by
+// the middleware, and unauthenticated requests are redirected to log in
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return m.server.Middleware(next)
+}
+
+// Reload swaps in a new config
+func (m *Middleware) Reload(config *Config) error {
+	return m.server.Reload(config.config)
+}
+
+// UserFromContext returns the authenticated user from the context of a
+// request passed on by the middleware
+func UserFromContext(ctx context.Context) (User, bool) {
+	return tfa.UserFromContext(ctx)
+}
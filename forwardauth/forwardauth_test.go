@@ -0,0 +1,157 @@
+package forwardauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tfa "github.com/rajasoun/traefik-forward-auth/internal"
+)
+
+// newTestConfig parses a config with an OIDC provider served by a test
+// issuer, and a webhook which adds an entitlements header
+func newTestConfig(t *testing.T, opts ...Option) *Config {
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%[1]s/auth","token_endpoint":"%[1]s/token","jwks_uri":"%[1]s/keys"}`, issuer.URL)
+	}))
+	t.Cleanup(issuer.Close)
+
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(tfa.WebhookResponse{
+			Allow:   true,
+			Headers: map[string]string{"X-Entitlements": "payroll:read"},
+		})
+	}))
+	t.Cleanup(webhook.Close)
+
+	args := []string{
+		"--secret=abc",
+		"--cookie-hash-key=AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+		"--cookie-block-key=R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+		"--default-provider=oidc",
+		"--providers.oidc.issuer-url=" + issuer.URL,
+		"--providers.oidc.client-id=id",
+		"--providers.oidc.client-secret=secret",
+	}
+	opts = append([]Option{
+		WithRule("payroll", Rule{Rule: "PathPrefix(`/payroll`)", Webhook: webhook.URL}),
+	}, opts...)
+	config, err := ParseConfig(args, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestMiddleware_Wrap(t *testing.T) {
+	config := newTestConfig(t,
+		WithRule("public", Rule{Action: "allow", Rule: "PathPrefix(`/public`)"}),
+		WithRule("admin", Rule{Action: "deny", Rule: "PathPrefix(`/admin`)", Priority: 1}),
+	)
+	mw, err := New(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("X-Forwarded-Host", "example.com")
+	cookie := tfa.NewAuth(config.config).MakeCookie(r, "test@example.com")
+
+	tests := []struct {
+		name             string
+		uri              string
+		authenticated    bool
+		wantCode         int
+		wantNext         bool
+		wantLocation     string
+		wantUser         string
+		wantEntitlements string
+	}{
+		{
+			name:     "test allow rule",
+			uri:      "/public",
+			wantCode: http.StatusOK,
+			wantNext: true,
+		},
+		{
+			name:          "test deny rule",
+			uri:           "/admin",
+			authenticated: true,
+			wantCode:      http.StatusForbidden,
+		},
+		{
+			name:         "test unauthenticated redirect",
+			uri:          "/payroll",
+			wantCode:     http.StatusTemporaryRedirect,
+			wantLocation: "/auth?",
+		},
+		{
+			name:             "test webhook headers",
+			uri:              "/payroll",
+			authenticated:    true,
+			wantCode:         http.StatusOK,
+			wantNext:         true,
+			wantUser:         "test@example.com",
+			wantEntitlements: "payroll:read",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			var user, entitlements string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				if u, ok := UserFromContext(r.Context()); ok {
+					user = u.Email
+				}
+				entitlements = r.Header.Get("X-Entitlements")
+			})
+
+			r := httptest.NewRequest("GET", "http://example.com"+tt.uri, nil)
+			if tt.authenticated {
+				r.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			mw.Wrap(next).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Middleware.Wrap() code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if called != tt.wantNext {
+				t.Errorf("Middleware.Wrap() called next = %v, want %v", called, tt.wantNext)
+			}
+			if location := w.Header().Get("Location"); !strings.Contains(location, tt.wantLocation) {
+				t.Errorf("Middleware.Wrap() location = %q, want %q", location, tt.wantLocation)
+			}
+			if user != tt.wantUser {
+				t.Errorf("UserFromContext() = %q, want %q", user, tt.wantUser)
+			}
+			if entitlements != tt.wantEntitlements {
+				t.Errorf("Middleware.Wrap() X-Entitlements = %q, want %q", entitlements, tt.wantEntitlements)
+			}
+		})
+	}
+}
+
+func TestRule_args(t *testing.T) {
+	rule := Rule{
+		Action:          "auth",
+		Rule:            "Host(`example.com`)",
+		Whitelist:       []string{"alice@example.com", "bob@example.com"},
+		Priority:        2,
+		WebhookFailOpen: true,
+	}
+	want := []string{
+		"--rule.app.action=auth",
+		"--rule.app.rule=Host(`example.com`)",
+		"--rule.app.whitelist=alice@example.com,bob@example.com",
+		"--rule.app.priority=2",
+		"--rule.app.webhook-fail-open=true",
+	}
+	if got := rule.args("app"); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Rule.args() = %v, want %v", got, want)
+	}
+}
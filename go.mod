@@ -13,6 +13,7 @@ require (
 	github.com/thomseddon/go-flags v1.4.1-0.20190507184247-a3629c504486
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	gopkg.in/square/go-jose.v2 v2.3.1
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 // From traefik
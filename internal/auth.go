@@ -5,9 +5,11 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -16,23 +18,132 @@ import (
 	"github.com/rajasoun/traefik-forward-auth/internal/provider"
 )
 
+// Auth validates and mints the cookies used by forward auth
+type Auth struct {
+	config *Config
+}
+
+// NewAuth creates an Auth bound to the given config
+func NewAuth(config *Config) *Auth {
+	return &Auth{config: config}
+}
+
 // Request Validation
 
 // ValidateCookie verifies that a cookie matches the expected format of:
 // Cookie = hash(secret, cookie domain, email, expires)|expires|email
-func ValidateCookie(r *http.Request, c *http.Cookie) (string, error) {
+func (a *Auth) ValidateCookie(r *http.Request, c *http.Cookie) (string, error) {
 	parts := strings.Split(c.Value, "|")
 
 	if len(parts) != 3 {
 		return "", errors.New("Invalid cookie format")
 	}
 
+	return a.validateSigned(r, parts)
+}
+
+// ReadUserCookie returns the user stored in the UserInfo cookie, which has
+// the same format as the auth cookie with the user info in place of email
+func (a *Auth) ReadUserCookie(r *http.Request) (provider.User, error) {
+	c, err := r.Cookie(a.config.UserInfoCookie)
+	if err != nil {
+		return provider.User{}, err
+	}
+
+	var value string
+	if err := securecookie.DecodeMulti(a.config.UserInfoCookie, c.Value, &value, a.userCookieCodecs()...); err != nil {
+		return provider.User{}, errors.New("Unable to decode user info cookie")
+	}
+
+	parts := strings.SplitN(value, "|", 3)
+	if len(parts) != 3 {
+		return provider.User{}, errors.New("Invalid cookie format")
+	}
+
+	userInfo, err := a.validateSigned(r, parts)
+	if err != nil {
+		return provider.User{}, err
+	}
+
+	return decodeUserInfo(userInfo)
+}
+
+// encodeUserInfo encodes the user as the info stored in the UserInfo cookie,
+// email|first name|last name in the legacy format, or the JSON encoded user
+func encodeUserInfo(user provider.User, format string) (string, error) {
+	if format != "json" {
+		return fmt.Sprintf("%s|%s|%s", user.Email, user.FirstName, user.LastName), nil
+	}
+
+	b, err := json.Marshal(user)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeUserInfo decodes the info stored in the UserInfo cookie, which is
+// either the JSON encoded user or, in the legacy format, email|first
+// name|last name
+func decodeUserInfo(userInfo string) (provider.User, error) {
+	if strings.HasPrefix(userInfo, "{") {
+		var user provider.User
+		if err := json.Unmarshal([]byte(userInfo), &user); err != nil {
+			return provider.User{}, errors.New("Invalid user info format")
+		}
+		return user, nil
+	}
+
+	info := strings.SplitN(userInfo, "|", 3)
+	if len(info) != 3 {
+		return provider.User{}, errors.New("Invalid user info format")
+	}
+
+	return provider.User{Email: info[0], FirstName: info[1], LastName: info[2]}, nil
+}
+
+// CookieInfo describes the contents of an auth or UserInfo cookie
+type CookieInfo struct {
+	Name    string
+	Value   string
+	Expires time.Time
+
+	// Err is the reason the cookie would be rejected, nil if it's valid
+	Err error
+}
+
+// InspectCookie decodes an auth or UserInfo cookie value, as selected by
+// name, reporting its contents even if it would be rejected
+func (a *Auth) InspectCookie(r *http.Request, name, value string) (*CookieInfo, error) {
+	if name == a.config.UserInfoCookie {
+		if err := securecookie.DecodeMulti(name, value, &value, a.userCookieCodecs()...); err != nil {
+			return nil, errors.New("Unable to decode user info cookie")
+		}
+	}
+
+	parts := strings.SplitN(value, "|", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid cookie format")
+	}
+
+	info := &CookieInfo{Name: name, Value: parts[2]}
+	if expires, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+		info.Expires = time.Unix(expires, 0)
+	}
+	_, info.Err = a.validateSigned(r, parts)
+
+	return info, nil
+}
+
+// validateSigned checks the mac and expiry of the mac, expires and value
+// parts of a cookie, returning the value
+func (a *Auth) validateSigned(r *http.Request, parts []string) (string, error) {
 	mac, err := base64.URLEncoding.DecodeString(parts[0])
 	if err != nil {
 		return "", errors.New("Unable to decode cookie mac")
 	}
 
-	expectedSignature := cookieSignature(r, parts[2], parts[1])
+	expectedSignature := a.cookieSignature(r, parts[2], parts[1])
 	expected, err := base64.URLEncoding.DecodeString(expectedSignature)
 	if err != nil {
 		return "", errors.New("Unable to generate mac")
@@ -60,12 +171,12 @@ func ValidateCookie(r *http.Request, c *http.Cookie) (string, error) {
 // ValidateEmail checks if the given email address matches either a whitelisted
 // email address, as defined by the "whitelist" config parameter. Or is part of
 // a permitted domain, as defined by the "domains" config parameter
-func ValidateEmail(email, ruleName string) bool {
+func (a *Auth) ValidateEmail(email, ruleName string) bool {
 	// Use global config by default
-	whitelist := config.Whitelist
-	domains := config.Domains
+	whitelist := a.config.Whitelist
+	domains := a.config.Domains
 
-	if rule, ok := config.Rules[ruleName]; ok {
+	if rule, ok := a.config.Rules[ruleName]; ok {
 		// Override with rule config if found
 		if len(rule.Whitelist) > 0 || len(rule.Domains) > 0 {
 			whitelist = rule.Whitelist
@@ -85,7 +196,7 @@ func ValidateEmail(email, ruleName string) bool {
 		}
 
 		// If we're not matching *either*, stop here
-		if !config.MatchWhitelistOrDomain {
+		if !a.config.MatchWhitelistOrDomain {
 			return false
 		}
 	}
@@ -98,10 +209,10 @@ func ValidateEmail(email, ruleName string) bool {
 	return false
 }
 
-// ValidateWhitelist checks if the email is in whitelist
+// ValidateWhitelist checks if the email matches an entry in whitelist
 func ValidateWhitelist(email string, whitelist CommaSeparatedList) bool {
 	for _, whitelist := range whitelist {
-		if email == whitelist {
+		if matchPattern(whitelist, email) {
 			return true
 		}
 	}
@@ -110,12 +221,12 @@ func ValidateWhitelist(email string, whitelist CommaSeparatedList) bool {
 
 // ValidateDomains checks if the email matches a whitelisted domain
 func ValidateDomains(email string, domains CommaSeparatedList) bool {
-	parts := strings.Split(email, "@")
-	if len(parts) < 2 {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
 		return false
 	}
 	for _, domain := range domains {
-		if domain == parts[1] {
+		if matchDomain(domain, email[at+1:]) {
 			return true
 		}
 	}
@@ -139,27 +250,59 @@ func returnUrl(r *http.Request) string {
 	return fmt.Sprintf("%s%s", redirectBase(r), path)
 }
 
+// Get the provider chooser url for the given rule
+func (a *Auth) chooserUrl(r *http.Request, rule string) string {
+	q := url.Values{}
+	q.Set("rule", rule)
+	q.Set("rd", returnUrl(r))
+
+	return fmt.Sprintf("%s%s/choose?%s", redirectBase(r), a.config.Path, q.Encode())
+}
+
+// Check a redirect stays on the requested host, one of the cookie domains
+// or one of the allowed redirect hosts
+func (a *Auth) validRedirect(r *http.Request, redirect string) bool {
+	u, err := url.Parse(redirect)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+
+	host := strings.Split(r.Header.Get("X-Forwarded-Host"), ":")[0]
+	if u.Hostname() == host {
+		return true
+	}
+
+	for _, allowed := range a.config.AllowedRedirectHosts {
+		if strings.EqualFold(u.Hostname(), allowed) {
+			return true
+		}
+	}
+
+	match, _ := a.matchCookieDomains(u.Hostname())
+	return match
+}
+
 // Get oauth redirect uri
-func redirectUri(r *http.Request) string {
-	if use, _ := useAuthDomain(r); use {
+func (a *Auth) redirectUri(r *http.Request) string {
+	if use, _ := a.useAuthDomain(r); use {
 		proto := r.Header.Get("X-Forwarded-Proto")
-		return fmt.Sprintf("%s://%s%s", proto, config.AuthHost, config.Path)
+		return fmt.Sprintf("%s://%s%s", proto, a.config.AuthHost, a.config.Path)
 	}
 
-	return fmt.Sprintf("%s%s", redirectBase(r), config.Path)
+	return fmt.Sprintf("%s%s", redirectBase(r), a.config.Path)
 }
 
 // Should we use auth host + what it is
-func useAuthDomain(r *http.Request) (bool, string) {
-	if config.AuthHost == "" {
+func (a *Auth) useAuthDomain(r *http.Request) (bool, string) {
+	if a.config.AuthHost == "" {
 		return false, ""
 	}
 
 	// Does the request match a given cookie domain?
-	reqMatch, reqHost := matchCookieDomains(r.Header.Get("X-Forwarded-Host"))
+	reqMatch, reqHost := a.matchCookieDomains(r.Header.Get("X-Forwarded-Host"))
 
 	// Do any of the auth hosts match a cookie domain?
-	authMatch, authHost := matchCookieDomains(config.AuthHost)
+	authMatch, authHost := a.matchCookieDomains(a.config.AuthHost)
 
 	// We need both to match the same domain
 	return reqMatch && authMatch && reqHost == authHost, reqHost
@@ -168,64 +311,200 @@ func useAuthDomain(r *http.Request) (bool, string) {
 // Cookie methods
 
 // MakeCookie creates an auth cookie
-func MakeCookie(r *http.Request, email string) *http.Cookie {
-	expires := cookieExpiry()
-	mac := cookieSignature(r, email, fmt.Sprintf("%d", expires.Unix()))
+func (a *Auth) MakeCookie(r *http.Request, email string) *http.Cookie {
+	expires := a.cookieExpiry()
+	mac := a.cookieSignature(r, email, fmt.Sprintf("%d", expires.Unix()))
 	value := fmt.Sprintf("%s|%d|%s", mac, expires.Unix(), email)
 
 	return &http.Cookie{
-		Name:     config.CookieName,
+		Name:     a.config.CookieName,
 		Value:    value,
 		Path:     "/",
-		Domain:   cookieDomain(r),
+		Domain:   a.cookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !a.config.InsecureCookie,
 		Expires:  expires,
 	}
 }
 
+// MakeUserInfoCookie creates a UserInfo cookie for the user, in the
+// user-info-format. Cookies are limited to 4096 bytes, so the groups of a
+// user in too many to fit are left out
+func (a *Auth) MakeUserInfoCookie(r *http.Request, user provider.User) (*http.Cookie, error) {
+	userInfo, err := encodeUserInfo(user, a.config.UserInfoFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	cookie, err := a.MakeUserCookie(r, userInfo)
+	if err != nil && len(user.Groups) > 0 {
+		user.Groups = nil
+		return a.MakeUserInfoCookie(r, user)
+	}
+	return cookie, err
+}
+
 //
 // MakeUserCookie create's an UserInfo cookie
-func MakeUserCookie(r *http.Request, userInfo string) (*http.Cookie, error) {
-	var hashKey = []byte(config.CookieHashKey)
-	var blockKey = []byte(config.CookieBlockKey)
-	var s = securecookie.New(hashKey, blockKey)
-
-	expires := cookieExpiry()
-	mac := cookieSignature(r, userInfo, fmt.Sprintf("%d", expires.Unix()))
+func (a *Auth) MakeUserCookie(r *http.Request, userInfo string) (*http.Cookie, error) {
+	expires := a.cookieExpiry()
+	mac := a.cookieSignature(r, userInfo, fmt.Sprintf("%d", expires.Unix()))
 	value := fmt.Sprintf("%s|%d|%s", mac, expires.Unix(), userInfo)
 
-	encoded, err := s.Encode(config.UserInfoCookie, value)
+	encoded, err := a.userCookieCodecs()[0].Encode(a.config.UserInfoCookie, value)
 	if err != nil {
 		return nil, err
 	}
 
 	return &http.Cookie{
-		Name:     config.UserInfoCookie,
+		Name:     a.config.UserInfoCookie,
 		Value:    encoded,
 		Path:     "/",
-		Domain:   cookieDomain(r),
+		Domain:   a.cookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !a.config.InsecureCookie,
 		Expires:  expires,
 	}, nil
 }
 
+// userCookieCodecs creates the user info cookie codecs, the first, used to
+// encode, from the current keys and any second from the previous keys, so
+// cookies made before the keys were rotated can still be decoded
+func (a *Auth) userCookieCodecs() []securecookie.Codec {
+	pairs := [][]byte{[]byte(a.config.CookieHashKey), []byte(a.config.CookieBlockKey)}
+	if a.config.PreviousCookieHashKey != "" {
+		pairs = append(pairs, []byte(a.config.PreviousCookieHashKey), []byte(a.config.PreviousCookieBlockKey))
+	}
+	return securecookie.CodecsFromPairs(pairs...)
+}
+
+// MakeProviderCookie creates a cookie remembering the provider chosen by
+// the user
+func (a *Auth) MakeProviderCookie(r *http.Request, name string) *http.Cookie {
+	return &http.Cookie{
+		Name:     a.config.ProviderCookieName,
+		Value:    name,
+		Path:     "/",
+		Domain:   a.cookieDomain(r),
+		HttpOnly: true,
+		Secure:   !a.config.InsecureCookie,
+		Expires:  a.cookieExpiry(),
+	}
+}
+
+// stepUpCookieName names the cookie marking a step up login in progress
+func (a *Auth) stepUpCookieName() string {
+	return a.config.CSRFCookieName + "_step_up"
+}
+
+// MakeStepUpCookie marks a step up login started for the rule, so a session
+// still not meeting its requirements afterwards isn't sent to log in again
+func (a *Auth) MakeStepUpCookie(r *http.Request, rule string) *http.Cookie {
+	return &http.Cookie{
+		Name:     a.stepUpCookieName(),
+		Value:    rule,
+		Path:     "/",
+		Domain:   a.cookieDomain(r),
+		HttpOnly: true,
+		Secure:   !a.config.InsecureCookie,
+		Expires:  time.Now().Local().Add(time.Minute * 5),
+	}
+}
+
+// ClearStepUpCookie makes an expired step up cookie
+func (a *Auth) ClearStepUpCookie(r *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:     a.stepUpCookieName(),
+		Value:    "",
+		Path:     "/",
+		Domain:   a.cookieDomain(r),
+		HttpOnly: true,
+		Secure:   !a.config.InsecureCookie,
+		Expires:  time.Now().Local().Add(time.Hour * -1),
+	}
+}
+
+// steppedUp checks if a step up login was started for the rule
+func (a *Auth) steppedUp(r *http.Request, rule string) bool {
+	c, err := r.Cookie(a.stepUpCookieName())
+	return err == nil && c.Value == rule
+}
+
+// reauthCookieName names the cookie marking a re-authentication in progress
+func (a *Auth) reauthCookieName() string {
+	return a.config.CSRFCookieName + "_reauth"
+}
+
+// MakeReauthCookie marks a re-authentication started for the rule, so a
+// session still older than its max-auth-age afterwards isn't sent to log in
+// again. It expires before a session logged in since could be too old
+func (a *Auth) MakeReauthCookie(r *http.Request, rule string) *http.Cookie {
+	lifetime := time.Minute * 5
+	if rl, ok := a.config.Rules[rule]; ok && rl.MaxAuthAge > 0 && time.Duration(rl.MaxAuthAge)*time.Second < lifetime {
+		lifetime = time.Duration(rl.MaxAuthAge) * time.Second
+	}
+
+	return &http.Cookie{
+		Name:     a.reauthCookieName(),
+		Value:    rule,
+		Path:     "/",
+		Domain:   a.cookieDomain(r),
+		HttpOnly: true,
+		Secure:   !a.config.InsecureCookie,
+		Expires:  time.Now().Local().Add(lifetime),
+	}
+}
+
+// ClearReauthCookie makes an expired re-authentication cookie
+func (a *Auth) ClearReauthCookie(r *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:     a.reauthCookieName(),
+		Value:    "",
+		Path:     "/",
+		Domain:   a.cookieDomain(r),
+		HttpOnly: true,
+		Secure:   !a.config.InsecureCookie,
+		Expires:  time.Now().Local().Add(time.Hour * -1),
+	}
+}
+
+// reauthenticated checks if a re-authentication was started for the rule
+func (a *Auth) reauthenticated(r *http.Request, rule string) bool {
+	c, err := r.Cookie(a.reauthCookieName())
+	return err == nil && c.Value == rule
+}
+
+// rememberedProvider returns the provider previously chosen by the user, if
+// it is one of the given providers
+func (a *Auth) rememberedProvider(r *http.Request, names []string) provider.Provider {
+	c, err := r.Cookie(a.config.ProviderCookieName)
+	if err != nil || !contains(names, c.Value) {
+		return nil
+	}
+
+	p, err := a.config.GetConfiguredProvider(c.Value)
+	if err != nil {
+		return nil
+	}
+
+	return p
+}
+
 // ClearCookie clears the auth cookie
-func ClearCookie(r *http.Request) *http.Cookie {
+func (a *Auth) ClearCookie(r *http.Request) *http.Cookie {
 	return &http.Cookie{
-		Name:     config.CookieName,
+		Name:     a.config.CookieName,
 		Value:    "",
 		Path:     "/",
-		Domain:   cookieDomain(r),
+		Domain:   a.cookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !a.config.InsecureCookie,
 		Expires:  time.Now().Local().Add(time.Hour * -1),
 	}
 }
 
-func buildCSRFCookieName(nonce string) string {
-	return config.CSRFCookieName + "_" + nonce[:6]
+func (a *Auth) buildCSRFCookieName(nonce string) string {
+	return a.config.CSRFCookieName + "_" + nonce[:6]
 }
 
 // MakeCSRFCookie makes a csrf cookie (used during login only)
@@ -233,50 +512,60 @@ func buildCSRFCookieName(nonce string) string {
 // Note, CSRF cookies live shorter than auth cookies, a fixed 1h.
 // That's because some CSRF cookies may belong to auth flows that don't complete
 // and thus may not get cleared by ClearCookie.
-func MakeCSRFCookie(r *http.Request, nonce string) *http.Cookie {
+func (a *Auth) MakeCSRFCookie(r *http.Request, nonce string) *http.Cookie {
 	return &http.Cookie{
-		Name:     buildCSRFCookieName(nonce),
+		Name:     a.buildCSRFCookieName(nonce),
 		Value:    nonce,
 		Path:     "/",
-		Domain:   csrfCookieDomain(r),
+		Domain:   a.csrfCookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !a.config.InsecureCookie,
 		Expires:  time.Now().Local().Add(time.Hour * 1),
 	}
 }
 
 // ClearCSRFCookie makes an expired csrf cookie to clear csrf cookie
-func ClearCSRFCookie(r *http.Request, c *http.Cookie) *http.Cookie {
+func (a *Auth) ClearCSRFCookie(r *http.Request, c *http.Cookie) *http.Cookie {
 	return &http.Cookie{
 		Name:     c.Name,
 		Value:    "",
 		Path:     "/",
-		Domain:   csrfCookieDomain(r),
+		Domain:   a.csrfCookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !a.config.InsecureCookie,
 		Expires:  time.Now().Local().Add(time.Hour * -1),
 	}
 }
 
 // FindCSRFCookie extracts the CSRF cookie from the request based on state.
-func FindCSRFCookie(r *http.Request, state string) (c *http.Cookie, err error) {
+func (a *Auth) FindCSRFCookie(r *http.Request, state string) (c *http.Cookie, err error) {
 	// Check for CSRF cookie
-	return r.Cookie(buildCSRFCookieName(state))
+	return r.Cookie(a.buildCSRFCookieName(state))
 }
 
-// ValidateCSRFCookie validates the csrf cookie against state
-func ValidateCSRFCookie(c *http.Cookie, state string) (valid bool, provider string, redirect string, err error) {
+// ValidateCSRFCookie validates the csrf cookie against state, and the
+// state's signature
+func (a *Auth) ValidateCSRFCookie(c *http.Cookie, state string) (valid bool, provider string, redirect string, err error) {
 	if len(c.Value) != 32 {
 		return false, "", "", errors.New("Invalid CSRF cookie value")
 	}
 
 	// Check nonce match
-	if c.Value != state[:32] {
+	if len(state) < 33 || c.Value != state[:32] {
 		return false, "", "", errors.New("CSRF cookie does not match state")
 	}
 
+	// Check signature
+	sig := strings.LastIndex(state, ":")
+	if sig < 33 {
+		return false, "", "", errors.New("Invalid CSRF state format")
+	}
+	if !hmac.Equal([]byte(state[sig+1:]), []byte(a.stateSignature(state[:sig]))) {
+		return false, "", "", errors.New("Invalid CSRF state signature")
+	}
+
 	// Extract provider
-	params := state[33:]
+	params := state[33:sig]
 	split := strings.Index(params, ":")
 	if split == -1 {
 		return false, "", "", errors.New("Invalid CSRF state format")
@@ -286,9 +575,19 @@ func ValidateCSRFCookie(c *http.Cookie, state string) (valid bool, provider stri
 	return true, params[:split], params[split+1:], nil
 }
 
-// MakeState generates a state value
-func MakeState(r *http.Request, p provider.Provider, nonce string) string {
-	return fmt.Sprintf("%s:%s:%s", nonce, p.Name(), returnUrl(r))
+// MakeState generates a state value, redirect is where the user is sent once
+// logged in. It's signed so the provider and redirect can't be changed
+func (a *Auth) MakeState(redirect string, p provider.Provider, nonce string) string {
+	state := fmt.Sprintf("%s:%s:%s", nonce, p.Name(), redirect)
+	return state + ":" + a.stateSignature(state)
+}
+
+// stateSignature signs the nonce, provider and redirect of a state value
+func (a *Auth) stateSignature(state string) string {
+	hash := hmac.New(sha256.New, a.config.Secret)
+	hash.Write([]byte("state"))
+	hash.Write([]byte(state))
+	return base64.URLEncoding.EncodeToString(hash.Sum(nil))
 }
 
 // ValidateState checks whether the state is of right length.
@@ -311,18 +610,18 @@ func Nonce() (error, string) {
 }
 
 // Cookie domain
-func cookieDomain(r *http.Request) string {
+func (a *Auth) cookieDomain(r *http.Request) string {
 	host := r.Header.Get("X-Forwarded-Host")
 
 	// Check if any of the given cookie domains matches
-	_, domain := matchCookieDomains(host)
+	_, domain := a.matchCookieDomains(host)
 	return domain
 }
 
 // Cookie domain
-func csrfCookieDomain(r *http.Request) string {
+func (a *Auth) csrfCookieDomain(r *http.Request) string {
 	var host string
-	if use, domain := useAuthDomain(r); use {
+	if use, domain := a.useAuthDomain(r); use {
 		host = domain
 	} else {
 		host = r.Header.Get("X-Forwarded-Host")
@@ -334,11 +633,11 @@ func csrfCookieDomain(r *http.Request) string {
 }
 
 // Return matching cookie domain if exists
-func matchCookieDomains(domain string) (bool, string) {
+func (a *Auth) matchCookieDomains(domain string) (bool, string) {
 	// Remove port
 	p := strings.Split(domain, ":")
 
-	for _, d := range config.CookieDomains {
+	for _, d := range a.config.CookieDomains {
 		if d.Match(p[0]) {
 			return true, d.Domain
 		}
@@ -347,18 +646,27 @@ func matchCookieDomains(domain string) (bool, string) {
 	return false, p[0]
 }
 
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 // Create cookie hmac
-func cookieSignature(r *http.Request, email, expires string) string {
-	hash := hmac.New(sha256.New, config.Secret)
-	hash.Write([]byte(cookieDomain(r)))
+func (a *Auth) cookieSignature(r *http.Request, email, expires string) string {
+	hash := hmac.New(sha256.New, a.config.Secret)
+	hash.Write([]byte(a.cookieDomain(r)))
 	hash.Write([]byte(email))
 	hash.Write([]byte(expires))
 	return base64.URLEncoding.EncodeToString(hash.Sum(nil))
 }
 
 // Get cookie expiry
-func cookieExpiry() time.Time {
-	return time.Now().Local().Add(config.Lifetime)
+func (a *Auth) cookieExpiry() time.Time {
+	return time.Now().Local().Add(a.config.Lifetime)
 }
 
 // CookieDomain holds cookie domain info
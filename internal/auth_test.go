@@ -3,12 +3,14 @@ package tfa
 import (
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/securecookie"
+	"github.com/rajasoun/traefik-forward-auth/internal/provider"
 )
 
 var (
@@ -20,14 +22,14 @@ var (
 	req               *http.Request
 )
 
-func setupTest(t *testing.T) func(t *testing.T) {
+func setupTest(t *testing.T) *Config {
 	cookieHashKey = "AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN"
 	cookieBlockKey = "R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ"
 	userInfoCookie = "_user_info"
 	largeUserInfo2000 = `yqgdfodb48nzfejz4tyt1n62dazcgi6c2ro5vlnsvo2u7jke44ime9hq9iq0nxybzvd6kvfmm43vurdssvyu52sfm0bapb4jzecjlcpglz4thbq6eogpb1nythbp61gvkwx0iodqoy2wpk36k39x7s54rhnhvslnwfsov1tbziqgnzwubgt9x0uh2mufy09swmor1hhckh791b12y7f5bocpk8285bru3ut4l194cg5gduxym0r2a3lr5zyzm0ram8tqr7rw5bwhzkljgygm0xi1d22tk9srim4u8mwwjh5yh5j0yd7lrf9zcmn9s3gpjrf82ahrxkqcsyzh9lanc6au101p6wvkzh7thf3eom1ekeqj71tpd7iyuqfksytjnobag9tsbsqy87321jv9lwiqkm1mggeb8frzd1220wrsxre2jgbh3f4cdbb9tpnhqy8c3179qpkw82my07qetjvg9dqcrqqz88bzzjvecbxsdlkqneyaqfns1f5kaj1mj3enx1o8oydp4f5adacgqd8upf6y2d7wo8vclzial2dseijlk8puyks7lul4vb2bd7rzd23fj1t3jj3d1j4c5tf2lka370h5o1vnv80t8hgkzwibd10rj05buebkapkterweltat0u82az56pre2r7wyhimrl302r61x5eekna9uyybqxrvzgn180r5c7kupl74o83ugxn5tknis0xkad9thceolh8r1d228pqzah3tsiayaago47yc5tur8l1yiicjr8vlc6u31ir5017dhl1r53bwxsb9p3vpiva1ehlp2z8c8ojxevfr2xroqgfx1pisq7enuper7yqdniwrejkhoqzgbivw4fnwv7olrfjxz6wwyogu3n52o7he4yfyaafwwfszbukabw0x6v4igse08rlnjsdgteyjha8767q8vfq800eop2g703125t4nhxpqkidyph2iuwclxri7qhkgs8ducxlksvxj27ibjmq7u9ty9j8sjv5sydotpi1f7idrarg5nfjhru4r6987qjwdf7g5n7r8gh6h9iedvk1s3f5npa24xztmwj0p2mkopcuwjlybhh7yonswem218gd93hpz8fc41vsnnjyemlcwjdmcf4bmbfgdjzi43w9gubdsr93suq9dledeajybd2s4wjicpyc8uu7pygmqgkoywkju60mpxc2lyoy6neuoitqrmcu10sdmp65dp14k8i1uynay6r9yycnb3nkcyvxlz4os3c4dtg2xqbqxjuc3dwjuf4u5rubjxdmhmwt77ta9rdknhnw1l9yc5b6g4smzeybfav17myhyc2y7rtppkb878h3dz3k2a4o8zndvxf78s0srml87suxry4t6lzssquihw6j2ak0cjb996p3onn1bek080y4oo7xph0qw1379mibxwdq5vjgv5qxdj9y3hjsa7myjmjyyb30nvz251xdxr0s8hj66q1va7z5fmd3rllhx9oeyf27j4lq4lbrqt0hf3uiigw71iij5h2nsaj1i2xbsqfw8m3uelu8op6ioij6ethz5x0upbux15tu1eaxsh13ozdh93yfq4yn59aokaloyh32lup7oi324upsjhvdisd5j4g9lckh1yrvajd1uemndswft3zw7kp1948gi1lrq4hq1rm0kgme52nh72hllacj431cxu9gtoegegrhlyyoy59dn8kecogd175kk73hw5l98qf8kwerk737qbbb6cb0ma4cmb5h8sx5apo9kk9j7ghd3joiszqk3qbqmk5potfcjaebtyyjs30ngtv6u0op42zrth0qsdh9mohbt9e0taonjn4t3ro1p3vx17vsp6bnenmpd2jsa9au3imqavp514b6ue9sgpfkxy94m4cej2814jq8js8d63ydvph801y78emcne94glho0x0ggpkx5oy73gq6ubtx7u548j2623wikx0iakckzfoxmqiz36vn5w9wjx`
 	largeUserInfo2500 = `4y93hjd9pfu91k3jtlhyjo9x3mcpmixlkcr1hycn66pviounbiqbouieu0idbxznkhgbnnxsux0fieyqh03dt2bdznb5q4hbbg52e7supslaljy6gwx5r5pkmfg4xhxrdv0wm1zi571z991t6jc9e7mzv7jzq4rqode2yse0yfbxuf4p963ukx3mw2z3i3dqdo6tgry3u9x8j93iy7hna55jppqaj68wsmsesutqkgle88tvrxmxt2rz7iqwsoh6w4dpwxpm4yxssvu2ga2vclyxk81j3ozf40c0lchjew1lcf7ubohmvj1p39oriduy8h580ydb2sj4uocp4j768joeyn2yewrirhhbaj7ndfepe1mghu8x7wbt246jdddzks1f030ouigjox7iw9z0bfcarryrva41zdok6q1es7lgei06qn1z56d5rolq4ne3fglmh6f75hlh3zcgd4yea1vlmbv3iwxyvnjnocl0n9gp8xhjlo2rph28tfdov17b77nf8bfq4cqfc85zydfewysjzi1hq3i9gpndtdthtrucl7v2owb1pucrcqqixr36i4gohmhp3c8luyck6n9g8t268bzvyy95vhf9gy65njkmiyjiiq0999dnwvyiy5gfgq399t13t5amqwaczjuc0fqqu9xrlyy7u604ldqkyzt6jcp23nu0jrhgv69o1bkknoq4qtdvgh3bl44ekupr0hexezxkfe4db8j1u1qkkuawq7u8ei39al7oyg4goltqse79bd30pensbg08p081vii6p618f8pma8viuzl538jy22znp12nt341dg2qy3jnq8yf4wl72982obxf1w0zywilemsa4u1zd1sqgyv1haeth9ommpbp0pwjz0edvobzhsla3zphxu5hsnyjmpojgun2erk9y209ua65j96eoe1q9p94462ok9y65vkfpa6ko5ccc4m9f8vyw3s3ic6t752gy6ludsn9h2uizc01b0zslo43qlunochvm7kvb4qyltmqkb7uomlkyhhxktmlosidrcbdygwum1l9l5ykx9l89ncpdg5enag5xpw1udu5np0mrmm52ehx0n1f6o1nj8sbzhk78n3bfz6ooeojneedk0i7ryudgko62iqcphtkn23zojoz8hmsuggqupuc6fvarf9uje4xwi8uqvueuwmrqp08q85nnojf1atojkh6gyx21nbo2s8j9v89vg441w1rpgo9pk2rjhmy457cw39twwfbnjrf52mv8wstw6mw1o80xsdrck25dk9480iuk5k0pw89nveq23qsbic9twc808vf0lmoxcyd56pmzbzkxuklktcc9n9dmoqx0ncudcomhdqx7fnotikvs7749rqk0db8q9i1jc9u0iybbos7qyw7tjsjx47bzonieoabd1u1m9d2ywf19ub1tda5di6adpbgaojtumld6j6ez2dtvong368kqhgchk5csg1pq8svf7f14pxdi1m1j0l3cebewtperrciq7csphaofq773odcrri9ymc35kb4t1vjl5y0rymajxa6f9b2egf6rhy4h5dfb8qr1fxkptw8h18qnnt0zsgn1m9l9ow15sdegmctch15fhrct5t3b29xr5e5eqprr51sjng4fc1ak794lz4gepza7tab6r8ua14xh4o47vq3cmtmvrtg0yae5v86n73o4mhzqhva7yivqfhlzdm8rn9m3x0403vjolhhjmyyt1eb4fvrhj3f2ogysrse6y6er1s06hr4mcklj8ub4dh17990opzum5k8xyibrczh84jynvwi0nkvshs5ey6eq3a930zmr9q8jnc7uj0ikx5azbgi2krhykorxo7jrvx5q7h2mwxjifokn2mvawjhui7xlsbl4gcuwub7qfj4icyalbiemd1r47gr49sd3yq6lcuftkotcro1pw49uge8f4cusssz47dpcx9k6zun8ya80njf5ijnoh5g90tbiuvtvcym2z8fc4wg3mc2l98neq05roy3p67my6jmon8mmz824ew5amp4z25hgw3kdf80fputwf0gx6er6jyoh9h4z6ottpzu1jnczytsumhcx1y582ye89k7xgf5sdhtk0w5l4oqbdqkzt8rokuhqknpbfgql3vgkdzqb5065tocq9eb77btyyavmijajvf70dpxnoarwdsch22csqrirc10x9i3mzu0izzbcl0h6fnp91jv3tu7qi8srjpudbl5ufslmi27h3ujzgpqaed8gbckgwxr6wt0v6lsq3xjwabm78y8tdobtaemjel38cwvlvh05l480p4cbsbyq8wimf48ab3wmvku07kd69ramd2g9zkg33o0fy4ak6l52rh4m5cb7gl2wlntghr3p2v97un21dmwuzi0fcqeg6sdozwcg5fpmhp94te6lp246068krowog1moxy45vnr8mwly8kcfqjiaaftkvweso3ukoq793dt`
 	req, _ = http.NewRequest("GET", "http://domain.com", nil)
-	config = &Config{
+	config := &Config{
 		CookieHashKey:  cookieHashKey,
 		CookieBlockKey: cookieBlockKey,
 		UserInfoCookie: userInfoCookie,
@@ -35,10 +37,10 @@ func setupTest(t *testing.T) func(t *testing.T) {
 	config.CSRFCookieName = "CSRFCookieName"
 	config.Rules = make(map[string]*Rule)
 	config.Lifetime = time.Second * time.Duration(43200)
-	return func(t *testing.T) {}
+	return config
 }
 func TestMakeUserCookie(t *testing.T) {
-	setupTest(t)
+	config := setupTest(t)
 	type args struct {
 		r        *http.Request
 		userInfo string
@@ -76,7 +78,7 @@ func TestMakeUserCookie(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := MakeUserCookie(tt.args.r, tt.args.userInfo)
+			got, err := NewAuth(config).MakeUserCookie(tt.args.r, tt.args.userInfo)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("MakeUserCookie() error = %v, wantErr %v", err, tt.wantErr)
 				t.Error(err)
@@ -102,7 +104,7 @@ func compareCookie(got, want *http.Cookie) bool {
 }
 
 func TestValidateCookie(t *testing.T) {
-	setupTest(t)
+	config := setupTest(t)
 	type args struct {
 		r *http.Request
 		c *http.Cookie
@@ -188,7 +190,7 @@ func TestValidateCookie(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := ValidateCookie(tt.args.r, tt.args.c)
+			got, err := NewAuth(config).ValidateCookie(tt.args.r, tt.args.c)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ValidateCookie() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -201,7 +203,7 @@ func TestValidateCookie(t *testing.T) {
 }
 
 func TestValidateEmail(t *testing.T) {
-	setupTest(t)
+	config := setupTest(t)
 	config.MatchWhitelistOrDomain = true
 	type args struct {
 		email    string
@@ -313,7 +315,7 @@ func TestValidateEmail(t *testing.T) {
 		config.Domains = tt.domains
 		config.MatchWhitelistOrDomain = tt.matchWhitelistOrDomain
 		t.Run(tt.name, func(t *testing.T) {
-			if got := ValidateEmail(tt.args.email, tt.args.ruleName); got != tt.want {
+			if got := NewAuth(config).ValidateEmail(tt.args.email, tt.args.ruleName); got != tt.want {
 				t.Errorf("ValidateEmail() = %v, want %v", got, tt.want)
 			}
 		})
@@ -321,7 +323,7 @@ func TestValidateEmail(t *testing.T) {
 }
 
 func TestMakeCookie(t *testing.T) {
-	setupTest(t)
+	config := setupTest(t)
 	type args struct {
 		r     *http.Request
 		email string
@@ -341,7 +343,7 @@ func TestMakeCookie(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := MakeCookie(tt.args.r, tt.args.email); !strings.Contains(got.Value, tt.want.Value) {
+			if got := NewAuth(config).MakeCookie(tt.args.r, tt.args.email); !strings.Contains(got.Value, tt.want.Value) {
 				t.Errorf("MakeCookie() = %v, want %v", got, tt.want)
 			}
 		})
@@ -349,7 +351,7 @@ func TestMakeCookie(t *testing.T) {
 }
 
 func TestMakeCSRFCookie(t *testing.T) {
-	setupTest(t)
+	config := setupTest(t)
 	type args struct {
 		r     *http.Request
 		nonce string
@@ -370,7 +372,7 @@ func TestMakeCSRFCookie(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := MakeCSRFCookie(tt.args.r, tt.args.nonce); !strings.Contains(got.Value, tt.want.Value) && got.Expires.Before(tt.want.Expires) {
+			if got := NewAuth(config).MakeCSRFCookie(tt.args.r, tt.args.nonce); !strings.Contains(got.Value, tt.want.Value) && got.Expires.Before(tt.want.Expires) {
 				t.Errorf("MakeCSRFCookie() = %v, want %v", got, tt.want)
 			}
 		})
@@ -378,7 +380,7 @@ func TestMakeCSRFCookie(t *testing.T) {
 }
 
 func TestClearCookie(t *testing.T) {
-	setupTest(t)
+	config := setupTest(t)
 	type args struct {
 		r *http.Request
 	}
@@ -397,7 +399,7 @@ func TestClearCookie(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := ClearCookie(tt.args.r); got.Expires.Before(tt.want.Expires) {
+			if got := NewAuth(config).ClearCookie(tt.args.r); got.Expires.Before(tt.want.Expires) {
 				t.Errorf("ClearCookie() = %v, want %v", got, tt.want)
 			}
 		})
@@ -405,7 +407,7 @@ func TestClearCookie(t *testing.T) {
 }
 
 func TestClearCSRFCookie(t *testing.T) {
-	setupTest(t)
+	config := setupTest(t)
 	type args struct {
 		r *http.Request
 		c *http.Cookie
@@ -431,7 +433,7 @@ func TestClearCSRFCookie(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := ClearCSRFCookie(tt.args.r, tt.args.c); got.Expires.Before(tt.want.Expires) {
+			if got := NewAuth(config).ClearCSRFCookie(tt.args.r, tt.args.c); got.Expires.Before(tt.want.Expires) {
 				t.Errorf("ClearCSRFCookie() = %v, want %v", got, tt.want)
 			}
 		})
@@ -504,7 +506,7 @@ func Test_returnUrl(t *testing.T) {
 }
 
 func Test_redirectUri(t *testing.T) {
-	config = &Config{}
+	config := &Config{}
 	config.Path = "/path123"
 	config.CookieDomains = []CookieDomain{
 		{Domain: "fa",
@@ -557,15 +559,88 @@ func Test_redirectUri(t *testing.T) {
 			} else {
 				config.AuthHost = ""
 			}
-			if got := redirectUri(tt.args.r); got != tt.want {
+			if got := NewAuth(config).redirectUri(tt.args.r); got != tt.want {
 				t.Errorf("redirectUri() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func Test_validRedirect(t *testing.T) {
+	config := &Config{
+		CookieDomains:        []CookieDomain{*NewCookieDomain("example.com")},
+		AllowedRedirectHosts: []string{"partner.example.org"},
+	}
+	r := httptest.NewRequest("GET", "http://tfa", nil)
+	r.Header.Set("X-Forwarded-Host", "app.test:8443")
+
+	tests := []struct {
+		name     string
+		redirect string
+		want     bool
+	}{
+		{
+			name:     "test requested host",
+			redirect: "https://app.test:8443/page",
+			want:     true,
+		},
+		{
+			name:     "test cookie domain",
+			redirect: "https://wiki.example.com/page",
+			want:     true,
+		},
+		{
+			name:     "test allowed host",
+			redirect: "https://Partner.example.org/return",
+			want:     true,
+		},
+		{
+			name:     "test other host",
+			redirect: "https://evil.com/",
+			want:     false,
+		},
+		{
+			name:     "test allowed host suffix",
+			redirect: "https://evilpartner.example.org/",
+			want:     false,
+		},
+		{
+			name:     "test userinfo",
+			redirect: "https://example.com@evil.com/",
+			want:     false,
+		},
+		{
+			name:     "test protocol relative",
+			redirect: "//evil.com/",
+			want:     false,
+		},
+		{
+			name:     "test scheme",
+			redirect: "javascript:alert(1)",
+			want:     false,
+		},
+		{
+			name:     "test no host",
+			redirect: "https:///page",
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewAuth(config).validRedirect(r, tt.redirect); got != tt.want {
+				t.Errorf("validRedirect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestValidateCSRFCookie(t *testing.T) {
-	setupTest(t)
+	config := setupTest(t)
+	config.Secret = []byte("secret")
+	a := NewAuth(config)
+	sign := func(state string) string {
+		return state + ":" + a.stateSignature(state)
+	}
 	type args struct {
 		c     *http.Cookie
 		state string
@@ -593,7 +668,7 @@ func TestValidateCSRFCookie(t *testing.T) {
 				c: &http.Cookie{
 					Value: "1eb323c2a633a505db17bd86d9bb4977",
 				},
-				state: "_NON_MATCHING_STRING_FOR_STATE__:Param1:Param2",
+				state: sign("_NON_MATCHING_STRING_FOR_STATE__:Param1:Param2"),
 			},
 			wantValid:    false,
 			wantProvider: "",
@@ -614,22 +689,61 @@ func TestValidateCSRFCookie(t *testing.T) {
 			wantErr:      true,
 		},
 		{
-			name: "Valid Cookie",
+			name: "Invalid CSRF state unsigned",
 			args: args{
 				c: &http.Cookie{
 					Value: "1eb323c2a633a505db17bd86d9bb4977",
 				},
 				state: "1eb323c2a633a505db17bd86d9bb4977:Param1:Param2",
 			},
+			wantValid:    false,
+			wantProvider: "",
+			wantRedirect: "",
+			wantErr:      true,
+		},
+		{
+			name: "Invalid CSRF state tampered redirect",
+			args: args{
+				c: &http.Cookie{
+					Value: "1eb323c2a633a505db17bd86d9bb4977",
+				},
+				state: strings.Replace(sign("1eb323c2a633a505db17bd86d9bb4977:Param1:https://example.com/"), "example.com", "evil.com", 1),
+			},
+			wantValid:    false,
+			wantProvider: "",
+			wantRedirect: "",
+			wantErr:      true,
+		},
+		{
+			name: "Valid Cookie",
+			args: args{
+				c: &http.Cookie{
+					Value: "1eb323c2a633a505db17bd86d9bb4977",
+				},
+				state: sign("1eb323c2a633a505db17bd86d9bb4977:Param1:Param2"),
+			},
 			wantValid:    true,
 			wantProvider: "Param1",
 			wantRedirect: "Param2",
 			wantErr:      false,
 		},
+		{
+			name: "Valid Cookie with port in redirect",
+			args: args{
+				c: &http.Cookie{
+					Value: "1eb323c2a633a505db17bd86d9bb4977",
+				},
+				state: sign("1eb323c2a633a505db17bd86d9bb4977:oidc:https://example.com:8443/page"),
+			},
+			wantValid:    true,
+			wantProvider: "oidc",
+			wantRedirect: "https://example.com:8443/page",
+			wantErr:      false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotValid, gotProvider, gotRedirect, err := ValidateCSRFCookie(tt.args.c, tt.args.state)
+			gotValid, gotProvider, gotRedirect, err := a.ValidateCSRFCookie(tt.args.c, tt.args.state)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ValidateCSRFCookie() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -712,7 +826,7 @@ func TestValidateState(t *testing.T) {
 }
 
 func TestFindCSRFCookie(t *testing.T) {
-	setupTest(t)
+	config := setupTest(t)
 	type args struct {
 		r     *http.Request
 		state string
@@ -735,7 +849,7 @@ func TestFindCSRFCookie(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotC, err := FindCSRFCookie(tt.args.r, tt.args.state)
+			gotC, err := NewAuth(config).FindCSRFCookie(tt.args.r, tt.args.state)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("FindCSRFCookie() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -896,3 +1010,281 @@ func TestCookieDomains_MarshalFlag(t *testing.T) {
 		})
 	}
 }
+
+func TestAuth_InspectCookie(t *testing.T) {
+	config := setupTest(t)
+	config.Secret = []byte("secret")
+	auth := NewAuth(config)
+	r := newForwardedRequest("GET", "example.com", "/")
+
+	userCookie, err := auth.MakeUserCookie(r, "test@example.com|Test|User")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := &Config{Secret: config.Secret, Lifetime: -time.Hour}
+
+	tests := []struct {
+		name      string
+		cookie    *http.Cookie
+		wantValue string
+		wantErr   bool
+		wantValid bool
+	}{
+		{
+			name:      "test auth cookie",
+			cookie:    auth.MakeCookie(r, "test@example.com"),
+			wantValue: "test@example.com",
+			wantValid: true,
+		},
+		{
+			name:      "test user info cookie",
+			cookie:    userCookie,
+			wantValue: "test@example.com|Test|User",
+			wantValid: true,
+		},
+		{
+			name:      "test expired cookie",
+			cookie:    NewAuth(expired).MakeCookie(r, "test@example.com"),
+			wantValue: "test@example.com",
+			wantValid: false,
+		},
+		{
+			name:      "test invalid mac",
+			cookie:    &http.Cookie{Name: "_forward_auth", Value: "YWJj|3183023056|test@example.com"},
+			wantValue: "test@example.com",
+			wantValid: false,
+		},
+		{
+			name:    "test invalid format",
+			cookie:  &http.Cookie{Name: "_forward_auth", Value: "xyz"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := auth.InspectCookie(r, tt.cookie.Name, tt.cookie.Value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InspectCookie() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Value != tt.wantValue || (got.Err == nil) != tt.wantValid {
+				t.Errorf("InspectCookie() = %+v, want value %v, valid %v", got, tt.wantValue, tt.wantValid)
+			}
+		})
+	}
+}
+
+func TestAuth_ReadUserCookie_rotation(t *testing.T) {
+	config := setupTest(t)
+	config.Secret = []byte("secret")
+	r := newForwardedRequest("GET", "example.com", "/")
+
+	oldCookie, err := NewAuth(config).MakeUserCookie(r, "test@example.com|Test|User")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := *config
+	rotated.CookieHashKey = "Q2NXL8WFA0J3HZK9VYB7D4M1RTE6GPSU"
+	rotated.CookieBlockKey = "H5T8N2KJX0QW9EZ4RMB7Y1LCVA6SDPGF"
+	rotated.PreviousCookieHashKey = config.CookieHashKey
+	rotated.PreviousCookieBlockKey = config.CookieBlockKey
+	newCookie, err := NewAuth(&rotated).MakeUserCookie(r, "test@example.com|Test|User")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := rotated
+	dropped.PreviousCookieHashKey = ""
+	dropped.PreviousCookieBlockKey = ""
+
+	tests := []struct {
+		name    string
+		config  *Config
+		cookie  *http.Cookie
+		wantErr bool
+	}{
+		{
+			name:   "test cookie made before rotation",
+			config: &rotated,
+			cookie: oldCookie,
+		},
+		{
+			name:   "test cookie made after rotation",
+			config: &rotated,
+			cookie: newCookie,
+		},
+		{
+			name:    "test cookie made with dropped keys",
+			config:  &dropped,
+			cookie:  oldCookie,
+			wantErr: true,
+		},
+		{
+			name:    "test new cookie with old keys",
+			config:  config,
+			cookie:  newCookie,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newForwardedRequest("GET", "example.com", "/")
+			req.AddCookie(tt.cookie)
+			got, err := NewAuth(tt.config).ReadUserCookie(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadUserCookie() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Email != "test@example.com" {
+				t.Errorf("ReadUserCookie() = %+v, want test@example.com", got)
+			}
+		})
+	}
+}
+
+func TestAuth_MakeUserInfoCookie(t *testing.T) {
+	config := setupTest(t)
+	config.Secret = []byte("secret")
+	r := newForwardedRequest("GET", "example.com", "/")
+
+	manyGroups := make([]string, 500)
+	for i := range manyGroups {
+		manyGroups[i] = fmt.Sprintf("group-%03d", i)
+	}
+	user := provider.User{Email: "test@example.com", FirstName: "Test", LastName: "User", Groups: []string{"ops"}}
+
+	tests := []struct {
+		name       string
+		format     string
+		groups     []string
+		wantValue  string
+		wantGroups []string
+	}{
+		{
+			name:      "test legacy",
+			format:    "legacy",
+			groups:    []string{"ops"},
+			wantValue: "test@example.com|Test|User",
+		},
+		{
+			name:       "test json",
+			format:     "json",
+			groups:     []string{"ops"},
+			wantValue:  `{"email":"test@example.com","given_name":"Test","family_name":"User","groups":["ops"]}`,
+			wantGroups: []string{"ops"},
+		},
+		{
+			name:      "test json groups too large",
+			format:    "json",
+			groups:    manyGroups,
+			wantValue: `{"email":"test@example.com","given_name":"Test","family_name":"User"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.UserInfoFormat = tt.format
+			auth := NewAuth(config)
+			user.Groups = tt.groups
+			c, err := auth.MakeUserInfoCookie(r, user)
+			if err != nil {
+				t.Fatalf("MakeUserInfoCookie() error = %v", err)
+			}
+			if len(c.String()) > 4096 {
+				t.Errorf("MakeUserInfoCookie() length = %d, want at most 4096", len(c.String()))
+			}
+
+			info, err := auth.InspectCookie(r, c.Name, c.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Value != tt.wantValue {
+				t.Errorf("MakeUserInfoCookie() value = %s, want %s", info.Value, tt.wantValue)
+			}
+
+			req := newForwardedRequest("GET", "example.com", "/")
+			req.AddCookie(c)
+			got, err := auth.ReadUserCookie(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Email != user.Email || !reflect.DeepEqual(got.Groups, tt.wantGroups) {
+				t.Errorf("ReadUserCookie() = %+v, want groups %v", got, tt.wantGroups)
+			}
+		})
+	}
+}
+
+func TestAuth_MakeReauthCookie(t *testing.T) {
+	config := setupTest(t)
+	config.Rules = map[string]*Rule{
+		"short": {MaxAuthAge: 60},
+		"long":  {MaxAuthAge: 3600},
+	}
+	auth := NewAuth(config)
+	r := newForwardedRequest("GET", "example.com", "/")
+
+	tests := []struct {
+		rule string
+		want time.Duration
+	}{
+		{rule: "short", want: time.Minute},
+		{rule: "long", want: time.Minute * 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			c := auth.MakeReauthCookie(r, tt.rule)
+			if got := time.Until(c.Expires); got > tt.want || got < tt.want-time.Second*5 {
+				t.Errorf("MakeReauthCookie() expires in %v, want %v", got, tt.want)
+			}
+
+			req := newForwardedRequest("GET", "example.com", "/")
+			req.AddCookie(c)
+			if !auth.reauthenticated(req, tt.rule) {
+				t.Errorf("reauthenticated() = false, want true")
+			}
+		})
+	}
+}
+
+func Test_decodeUserInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		userInfo string
+		want     provider.User
+		wantErr  bool
+	}{
+		{
+			name:     "test json",
+			userInfo: `{"email":"test@example.com","given_name":"Test","groups":["ops"]}`,
+			want:     provider.User{Email: "test@example.com", FirstName: "Test", Groups: []string{"ops"}},
+		},
+		{
+			name:     "test legacy",
+			userInfo: "test@example.com|Test|User",
+			want:     provider.User{Email: "test@example.com", FirstName: "Test", LastName: "User"},
+		},
+		{
+			name:     "test invalid json",
+			userInfo: `{"email":`,
+			wantErr:  true,
+		},
+		{
+			name:     "test invalid legacy",
+			userInfo: "test@example.com",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeUserInfo(tt.userInfo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeUserInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeUserInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
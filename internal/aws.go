@@ -5,58 +5,128 @@ import (
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 )
 
 // SecretsMgr interface has the methods that are required to access secrets stored in aws
 type SecretsMgr interface {
-	getAwsSession(secretMgrAccessKey, secretMgrSecretKey, secretMgrRegion string) (secretsmanageriface.SecretsManagerAPI, error)
-	getSecret(svc secretsmanageriface.SecretsManagerAPI, secretName string) (string, string, error)
+	getAwsSession(secretMgrAccessKey, secretMgrSecretKey, secretMgrSessionToken, secretMgrRegion, secretMgrRoleARN string) (secretsmanageriface.SecretsManagerAPI, error)
+	getSecret(svc secretsmanageriface.SecretsManagerAPI, secretName string) (*Secrets, error)
+	getSecretStage(svc secretsmanageriface.SecretsManagerAPI, secretName, versionStage string) (*Secrets, error)
+	getSsmClient(secretMgrAccessKey, secretMgrSecretKey, secretMgrSessionToken, secretMgrRegion, secretMgrRoleARN string) (ssmiface.SSMAPI, error)
+	getParameter(svc ssmiface.SSMAPI, parameterName string) (*Secrets, error)
 }
 
 type secretsMgr struct{}
 
-func (secretsMgr) getAwsSession(secretMgrAccessKey, secretMgrSecretKey, secretMgrRegion string) (secretsmanageriface.SecretsManagerAPI, error) {
-	creds := credentials.NewStaticCredentials(secretMgrAccessKey, secretMgrSecretKey, "")
-	_, err := creds.Get()
+func (secretsMgr) getAwsSession(secretMgrAccessKey, secretMgrSecretKey, secretMgrSessionToken, secretMgrRegion, secretMgrRoleARN string) (secretsmanageriface.SecretsManagerAPI, error) {
+	sess, cfg, err := newAwsSession(secretMgrAccessKey, secretMgrSecretKey, secretMgrSessionToken, secretMgrRegion, secretMgrRoleARN)
 	if err != nil {
 		return nil, err
 	}
-	cfg := aws.NewConfig().WithRegion(secretMgrRegion).WithCredentials(creds)
 
-	sess, err := session.NewSession(cfg)
-	if err != nil {
-		return nil, err
-	}
-
-	svc := secretsmanager.New(sess,
-		aws.NewConfig().WithRegion(secretMgrRegion))
+	return secretsmanager.New(sess, cfg), nil
+}
 
-	return svc, nil
+func (m secretsMgr) getSecret(svc secretsmanageriface.SecretsManagerAPI, secretName string) (*Secrets, error) {
+	return m.getSecretStage(svc, secretName, "AWSCURRENT")
 }
 
-func (secretsMgr) getSecret(svc secretsmanageriface.SecretsManagerAPI, secretName string) (string, string, error) {
+// getSecretStage reads the secrets from the version of the secret with the
+// given stage, returning empty secrets if no version has the stage, as with
+// "AWSPREVIOUS" before the secret is first rotated
+func (secretsMgr) getSecretStage(svc secretsmanageriface.SecretsManagerAPI, secretName, versionStage string) (*Secrets, error) {
 	input := &secretsmanager.GetSecretValueInput{
 		SecretId:     aws.String(secretName),
-		VersionStage: aws.String("AWSCURRENT"),
+		VersionStage: aws.String(versionStage),
 	}
 	result, err := svc.GetSecretValue(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException && versionStage != "AWSCURRENT" {
+		return &Secrets{}, nil
+	}
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 	if result.SecretString == nil {
-		return "", "", fmt.Errorf("secret string empty")
+		return nil, fmt.Errorf("secret string empty")
 	}
 
-	payload := struct {
-		HashKey  string `json:"hash-key,omitempty"`
-		BlockKey string `json:"block-key,omitempty"`
-	}{}
-	if err := json.Unmarshal([]byte(*result.SecretString), &payload); err != nil {
-		return "", "", err
+	return parseSecretPayload(*result.SecretString)
+}
+
+func (secretsMgr) getSsmClient(secretMgrAccessKey, secretMgrSecretKey, secretMgrSessionToken, secretMgrRegion, secretMgrRoleARN string) (ssmiface.SSMAPI, error) {
+	sess, cfg, err := newAwsSession(secretMgrAccessKey, secretMgrSecretKey, secretMgrSessionToken, secretMgrRegion, secretMgrRoleARN)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssm.New(sess, cfg), nil
+}
+
+// getParameter reads the secrets from an SSM Parameter Store parameter, which
+// may be a SecureString
+func (secretsMgr) getParameter(svc ssmiface.SSMAPI, parameterName string) (*Secrets, error) {
+	input := &ssm.GetParameterInput{
+		Name:           aws.String(parameterName),
+		WithDecryption: aws.Bool(true),
+	}
+	result, err := svc.GetParameter(input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Parameter == nil || result.Parameter.Value == nil {
+		return nil, fmt.Errorf("parameter value empty")
+	}
+
+	return parseSecretPayload(*result.Parameter.Value)
+}
+
+// newAwsSession creates a session using the static keys, and the session
+// token of temporary keys, when given, otherwise the SDK default credential
+// chain: shared config profiles, web identity tokens and instance or task
+// roles. If roleARN is given, that role is assumed with the session's
+// credentials
+func newAwsSession(accessKey, secretKey, sessionToken, region, roleARN string) (*session.Session, *aws.Config, error) {
+	cfg := aws.NewConfig().WithRegion(region)
+
+	var sess *session.Session
+	var err error
+	if accessKey != "" || secretKey != "" {
+		creds := credentials.NewStaticCredentials(accessKey, secretKey, sessionToken)
+		if _, err := creds.Get(); err != nil {
+			return nil, nil, err
+		}
+		sess, err = session.NewSession(aws.NewConfig().WithRegion(region).WithCredentials(creds))
+	} else {
+		sess, err = session.NewSessionWithOptions(session.Options{
+			Config:            *aws.NewConfig().WithRegion(region),
+			SharedConfigState: session.SharedConfigEnable,
+		})
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if roleARN != "" {
+		cfg = cfg.WithCredentials(stscreds.NewCredentials(sess, roleARN))
+	}
+
+	return sess, cfg, nil
+}
+
+// parseSecretPayload reads the secrets from the JSON stored in AWS, the same
+// object as every other backend
+func parseSecretPayload(value string) (*Secrets, error) {
+	s := &Secrets{}
+	if err := json.Unmarshal([]byte(value), s); err != nil {
+		return nil, err
 	}
-	return payload.HashKey, payload.BlockKey, nil
+	return s, nil
 }
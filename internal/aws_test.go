@@ -6,10 +6,13 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 )
 
 func Test_getAwsSession(t *testing.T) {
@@ -51,7 +54,7 @@ func Test_getAwsSession(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			sec := secretsMgr{}
-			got, err := sec.getAwsSession(tt.args.secretMgrAccessKey, tt.args.secretMgrSecretKey, tt.args.secretMgrRegion)
+			got, err := sec.getAwsSession(tt.args.secretMgrAccessKey, tt.args.secretMgrSecretKey, "", tt.args.secretMgrRegion, "")
 			if (err != nil) != tt.wantErr {
 				t.Errorf("getAwsSession() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -74,8 +77,7 @@ func Test_getSecret(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
-		want    string
-		want1   string
+		want    *Secrets
 		wantErr bool
 	}{
 		{
@@ -84,24 +86,173 @@ func Test_getSecret(t *testing.T) {
 				svc:        mockSvc,
 				secretName: secretName,
 			},
-			want:    "HashKey",
-			want1:   "BlockKey",
+			want: &Secrets{
+				HashKey:      "HashKey",
+				BlockKey:     "BlockKey",
+				Secret:       "Secret",
+				ClientSecret: "ClientSecret",
+			},
 			wantErr: false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			sec := secretsMgr{}
-			got, got1, err := sec.getSecret(tt.args.svc, tt.args.secretName)
+			got, err := sec.getSecret(tt.args.svc, tt.args.secretName)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("getSecret() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if got != tt.want {
-				t.Errorf("getSecret() got = %v, want %v", got, tt.want)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getSecret() got = %+v, want %+v", got, tt.want)
 			}
-			if got1 != tt.want1 {
-				t.Errorf("getSecret() got1 = %v, want %v", got1, tt.want1)
+		})
+	}
+}
+
+func Test_getSecretStage(t *testing.T) {
+	tests := []struct {
+		name         string
+		versionStage string
+		want         *Secrets
+		wantErr      bool
+	}{
+		{
+			name:         "test previous version",
+			versionStage: "AWSPREVIOUS",
+			want:         &Secrets{HashKey: "PreviousHashKey", BlockKey: "PreviousBlockKey"},
+		},
+		{
+			name:         "test pending version missing",
+			versionStage: "AWSPENDING",
+			want:         &Secrets{},
+		},
+		{
+			name:         "test current version missing",
+			versionStage: "AWSCURRENT",
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sec := secretsMgr{}
+			got, err := sec.getSecretStage(&mockStagedSecretsManagerClient{}, secretName, tt.versionStage)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getSecretStage() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getSecretStage() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newAwsSession(t *testing.T) {
+	type args struct {
+		accessKey    string
+		secretKey    string
+		sessionToken string
+		roleARN      string
+	}
+	tests := []struct {
+		name             string
+		args             args
+		wantAssumed      bool
+		wantSessionToken string
+		wantErr          bool
+	}{
+		{
+			name: "test static keys",
+			args: args{
+				accessKey: secretMgrAccessKey,
+				secretKey: secretMgrSecretKey,
+			},
+		},
+		{
+			name: "test temporary keys",
+			args: args{
+				accessKey:    secretMgrAccessKey,
+				secretKey:    secretMgrSecretKey,
+				sessionToken: "session-token",
+			},
+			wantSessionToken: "session-token",
+		},
+		{
+			name: "test default credential chain",
+			args: args{},
+		},
+		{
+			name: "test assume role",
+			args: args{
+				roleARN: "arn:aws:iam::123456789012:role/traefik-forward-auth",
+			},
+			wantAssumed: true,
+		},
+		{
+			name: "test partial static keys",
+			args: args{
+				accessKey: secretMgrAccessKey,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess, cfg, err := newAwsSession(tt.args.accessKey, tt.args.secretKey, tt.args.sessionToken, secretMgrRegion, tt.args.roleARN)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newAwsSession() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if aws.StringValue(sess.Config.Region) != secretMgrRegion {
+				t.Errorf("newAwsSession() region = %v, want %v", aws.StringValue(sess.Config.Region), secretMgrRegion)
+			}
+			if (cfg.Credentials != nil) != tt.wantAssumed {
+				t.Errorf("newAwsSession() assumed role credentials = %v, want %v", cfg.Credentials != nil, tt.wantAssumed)
+			}
+			if tt.wantSessionToken != "" {
+				creds, err := sess.Config.Credentials.Get()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if creds.SessionToken != tt.wantSessionToken {
+					t.Errorf("newAwsSession() session token = %v, want %v", creds.SessionToken, tt.wantSessionToken)
+				}
+			}
+		})
+	}
+}
+
+func Test_getParameter(t *testing.T) {
+	tests := []struct {
+		name    string
+		svc     ssmiface.SSMAPI
+		want    *Secrets
+		wantErr bool
+	}{
+		{
+			name: "test secure string parameter",
+			svc:  &mockSSMClient{value: aws.String(`{"hash-key":"HashKey","block-key":"BlockKey","secret":"Secret"}`)},
+			want: &Secrets{HashKey: "HashKey", BlockKey: "BlockKey", Secret: "Secret"},
+		},
+		{
+			name:    "test empty parameter",
+			svc:     &mockSSMClient{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sec := secretsMgr{}
+			got, err := sec.getParameter(tt.svc, "/traefik-forward-auth/keys")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getParameter() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getParameter() got = %+v, want %+v", got, tt.want)
 			}
 		})
 	}
@@ -114,11 +265,41 @@ var (
 	secretName         string = "traefik-forward-auth"
 )
 
+// mockSecretsManagerClient has a current version with every secret, and a
+// previous version with the keys before the last rotation
 type mockSecretsManagerClient struct {
 	secretsmanageriface.SecretsManagerAPI
 }
 
 func (m *mockSecretsManagerClient) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
-	payload := `{"hash-key":"HashKey","block-key":"BlockKey"}`
+	payload := `{"hash-key":"HashKey","block-key":"BlockKey","secret":"Secret","client-secret":"ClientSecret"}`
+	if aws.StringValue(input.VersionStage) == "AWSPREVIOUS" {
+		payload = `{"hash-key":"PreviousHashKey","block-key":"PreviousBlockKey"}`
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: &payload}, nil
+}
+
+type mockSSMClient struct {
+	ssmiface.SSMAPI
+	value *string
+}
+
+func (m *mockSSMClient) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	if !aws.BoolValue(input.WithDecryption) {
+		return nil, fmt.Errorf("parameter not decrypted")
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: input.Name, Value: m.value}}, nil
+}
+
+// mockStagedSecretsManagerClient only has a version with the AWSPREVIOUS stage
+type mockStagedSecretsManagerClient struct {
+	secretsmanageriface.SecretsManagerAPI
+}
+
+func (m *mockStagedSecretsManagerClient) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	if aws.StringValue(input.VersionStage) != "AWSPREVIOUS" {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "version not found", nil)
+	}
+	payload := `{"hash-key":"PreviousHashKey","block-key":"PreviousBlockKey"}`
 	return &secretsmanager.GetSecretValueOutput{SecretString: &payload}, nil
 }
@@ -0,0 +1,152 @@
+package tfa
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The traefik rule parser has a fixed set of matchers, so ClientIP matchers
+// are rewritten as Headers matchers on synthetic headers, set on each
+// request for every address range the client IP is within
+
+const clientNetHeaderPrefix = "X-Tfa-Client-Net-"
+
+var clientIPMatcher = regexp.MustCompile(`ClientIP\(([^)]*)\)`)
+
+// clientIPArgs returns the addresses and ranges of each ClientIP matcher in
+// the rule expression
+func clientIPArgs(rule string) [][]string {
+	var args [][]string
+	for _, m := range clientIPMatcher.FindAllStringSubmatch(rule, -1) {
+		var list []string
+		for _, arg := range strings.Split(m[1], ",") {
+			list = append(list, strings.Trim(strings.TrimSpace(arg), "`\"'"))
+		}
+		args = append(args, list)
+	}
+	return args
+}
+
+// parseClientNet parses an address, as "10.0.0.1", or address range, as
+// "10.0.0.0/8"
+func parseClientNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ClientIP range %q", s)
+		}
+		return n, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ClientIP address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// clientNetHeader names the header set on requests from within n
+func clientNetHeader(n *net.IPNet) string {
+	ones, _ := n.Mask.Size()
+	return clientNetHeaderPrefix + hex.EncodeToString(n.IP) + "-" + strconv.Itoa(ones)
+}
+
+// formatClientIP rewrites each ClientIP matcher in the rule expression as
+// the Headers matchers for its address ranges. Matchers with an invalid
+// address are left for the router to reject
+func formatClientIP(rule string) string {
+	return clientIPMatcher.ReplaceAllStringFunc(rule, func(m string) string {
+		args := clientIPArgs(m)[0]
+		matchers := make([]string, 0, len(args))
+		for _, arg := range args {
+			n, err := parseClientNet(arg)
+			if err != nil {
+				return m
+			}
+			matchers = append(matchers, fmt.Sprintf("Headers(`%s`, `1`)", clientNetHeader(n)))
+		}
+		if len(matchers) == 1 {
+			return matchers[0]
+		}
+		return "(" + strings.Join(matchers, " || ") + ")"
+	})
+}
+
+// clientNets returns the address ranges used by the rules' ClientIP matchers
+func (c *Config) clientNets() []*net.IPNet {
+	var nets []*net.IPNet
+	seen := make(map[string]bool)
+	for _, name := range c.sortedRuleNames() {
+		for _, args := range clientIPArgs(c.Rules[name].Rule) {
+			for _, arg := range args {
+				n, err := parseClientNet(arg)
+				if err != nil || seen[clientNetHeader(n)] {
+					continue
+				}
+				seen[clientNetHeader(n)] = true
+				nets = append(nets, n)
+			}
+		}
+	}
+	return nets
+}
+
+// clientIP finds the client's address in X-Forwarded-For. Traefik appends
+// the address each request was received from, so the last entry is the
+// client unless there are trusted proxies in front of traefik, in which
+// case it's the entry that many hops before the last
+func (c *Config) clientIP(r *http.Request) string {
+	var entries []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, entry := range strings.Split(header, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+
+	i := len(entries) - 1 - c.TrustedProxyHops
+	if i < 0 {
+		i = 0
+	}
+
+	if host, _, err := net.SplitHostPort(entries[i]); err == nil {
+		return host
+	}
+	return entries[i]
+}
+
+// setClientNetHeaders replaces any client net headers on the request with
+// those for the ranges the client IP is within, so clients can't set them
+func (s *Server) setClientNetHeaders(r *http.Request) {
+	for name := range r.Header {
+		if strings.HasPrefix(name, clientNetHeaderPrefix) {
+			r.Header.Del(name)
+		}
+	}
+
+	if len(s.clientNets) == 0 {
+		return
+	}
+
+	ip := net.ParseIP(s.config.clientIP(r))
+	if ip == nil {
+		return
+	}
+	for _, n := range s.clientNets {
+		if n.Contains(ip) {
+			r.Header.Set(clientNetHeader(n), "1")
+		}
+	}
+}
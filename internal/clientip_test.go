@@ -0,0 +1,156 @@
+package tfa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_formatClientIP(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{
+			name: "test range",
+			rule: "ClientIP(`10.0.0.0/8`)",
+			want: "Headers(`X-Tfa-Client-Net-0a000000-8`, `1`)",
+		},
+		{
+			name: "test address",
+			rule: "PathPrefix(`/admin`) && ClientIP(`192.168.1.10`)",
+			want: "PathPrefix(`/admin`) && Headers(`X-Tfa-Client-Net-c0a8010a-32`, `1`)",
+		},
+		{
+			name: "test multiple",
+			rule: "ClientIP(`10.0.0.0/8`, `2001:db8::/32`)",
+			want: "(Headers(`X-Tfa-Client-Net-0a000000-8`, `1`) || Headers(`X-Tfa-Client-Net-20010db8000000000000000000000000-32`, `1`))",
+		},
+		{
+			name: "test invalid left for the router",
+			rule: "ClientIP(`10.0.0.0/33`)",
+			want: "ClientIP(`10.0.0.0/33`)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatClientIP(tt.rule); got != tt.want {
+				t.Errorf("formatClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_clientIP(t *testing.T) {
+	tests := []struct {
+		name string
+		xff  []string
+		hops int
+		want string
+	}{
+		{
+			name: "test no header",
+			want: "",
+		},
+		{
+			name: "test last entry added by traefik",
+			xff:  []string{"1.1.1.1, 10.0.0.5"},
+			want: "10.0.0.5",
+		},
+		{
+			name: "test trusted hop",
+			xff:  []string{"1.1.1.1, 2.2.2.2, 10.0.0.5"},
+			hops: 1,
+			want: "2.2.2.2",
+		},
+		{
+			name: "test more hops than entries",
+			xff:  []string{"1.1.1.1", "10.0.0.5"},
+			hops: 5,
+			want: "1.1.1.1",
+		},
+		{
+			name: "test port",
+			xff:  []string{"10.0.0.5:1234"},
+			want: "10.0.0.5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			for _, xff := range tt.xff {
+				r.Header.Add("X-Forwarded-For", xff)
+			}
+			c := &Config{TrustedProxyHops: tt.hops}
+			if got := c.clientIP(r); got != tt.want {
+				t.Errorf("Config.clientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_clientIPRules(t *testing.T) {
+	config := &Config{
+		DefaultAction: "deny",
+		Path:          "/_oauth",
+		Rules: map[string]*Rule{
+			"monitoring": {
+				Action: "allow",
+				Rule:   "PathPrefix(`/health`) && ClientIP(`10.1.0.0/16`, `192.168.1.10`)",
+			},
+		},
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		xff      string
+		spoofed  bool
+		wantCode int
+	}{
+		{
+			name:     "test range",
+			xff:      "10.1.2.3",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "test address",
+			xff:      "192.168.1.10",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "test outside range",
+			xff:      "10.2.0.1",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "test spoofed entry ignored",
+			xff:      "10.1.2.3, 8.8.8.8",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "test spoofed header removed",
+			xff:      "8.8.8.8",
+			spoofed:  true,
+			wantCode: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newForwardedRequest("GET", "example.com", "/health")
+			r.Header.Set("X-Forwarded-For", tt.xff)
+			if tt.spoofed {
+				r.Header.Set("X-Tfa-Client-Net-0a010000-16", "1")
+			}
+			w := httptest.NewRecorder()
+			s.RootHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("RootHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package tfa
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rajasoun/traefik-forward-auth/internal/provider"
+)
+
+// CheckConfig parses and validates the config given by args, returning
+// every problem found rather than stopping at the first. Offline skips the
+// secrets manager and provider discovery, which need network access
+func CheckConfig(args []string, sec SecretsMgr, offline bool) []error {
+	var errs []error
+	c := &Config{
+		Rules:       map[string]*Rule{},
+		unknownErrs: &errs,
+	}
+
+	if err := c.parseFlags(args); err != nil {
+		return append(errs, err)
+	}
+
+	c.transform()
+
+	// The env backend's keys are checked with the other problems
+	if !offline && c.secretsBackendName() != "env" {
+		if err := c.loadSecrets(sec); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return append(errs, c.problems(offline)...)
+}
+
+// CheckConfigCommand runs the check-config command, reporting problems to w
+// and returning the exit code
+func CheckConfigCommand(args []string, w io.Writer) int {
+	offline := false
+	var configArgs []string
+	for _, arg := range args {
+		if arg == "--offline" {
+			offline = true
+		} else {
+			configArgs = append(configArgs, arg)
+		}
+	}
+
+	var sec secretsMgr
+	errs := CheckConfig(configArgs, sec, offline)
+	if len(errs) == 0 {
+		fmt.Fprintln(w, "Config is valid")
+		return 0
+	}
+
+	fmt.Fprintf(w, "Config has %d problem(s):\n", len(errs))
+	for _, err := range errs {
+		fmt.Fprintf(w, "  - %v\n", err)
+	}
+	return 1
+}
+
+// parseConfig parses the config given by args without fetching secrets or
+// contacting providers, for commands which don't need them
+func parseConfig(args []string) (*Config, error) {
+	c := &Config{
+		Rules: map[string]*Rule{},
+	}
+
+	if err := c.parseFlags(args); err != nil {
+		return nil, err
+	}
+
+	c.transform()
+	return c, nil
+}
+
+// CookieCommand runs the cookie decode and mint commands, writing to w and
+// returning the exit code
+func CookieCommand(args []string, w io.Writer) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "decode":
+			return decodeCookieCommand(args[1:], w)
+		case "mint":
+			return mintCookieCommand(args[1:], w)
+		}
+	}
+
+	fmt.Fprintln(w, "usage: cookie decode --host=<host> --value=<value> [--name=<cookie name>]")
+	fmt.Fprintln(w, "       cookie mint --host=<host> --email=<email> [--lifetime=<seconds>] [--first-name=<name>] [--last-name=<name>] [--groups=<group,...>]")
+	return 2
+}
+
+// decodeCookieCommand decodes and verifies a cookie value, as it would be by
+// requests to host
+func decodeCookieCommand(args []string, w io.Writer) int {
+	opts := map[string]string{"host": "", "value": "", "name": ""}
+	c, err := parseConfig(extractArgs(args, opts))
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	if opts["host"] == "" || opts["value"] == "" {
+		fmt.Fprintln(w, "--host and --value are required")
+		return 2
+	}
+	if opts["name"] == "" {
+		opts["name"] = c.CookieName
+	}
+
+	if opts["name"] == c.UserInfoCookie {
+		var sec secretsMgr
+		if err := c.loadSecrets(sec); err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+	}
+
+	info, err := NewAuth(c).InspectCookie(cookieRequest(opts["host"]), opts["name"], opts["value"])
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+
+	fmt.Fprintf(w, "Cookie:  %s\n", info.Name)
+	fmt.Fprintf(w, "Value:   %s\n", info.Value)
+	fmt.Fprintf(w, "Expires: %s\n", info.Expires.Format(time.RFC3339))
+	if info.Err != nil {
+		fmt.Fprintf(w, "Invalid: %v\n", info.Err)
+		return 1
+	}
+	fmt.Fprintln(w, "Valid:   signature verified and not expired")
+	return 0
+}
+
+// mintCookieCommand creates cookies for email, valid for requests to host
+func mintCookieCommand(args []string, w io.Writer) int {
+	opts := map[string]string{"host": "", "email": "", "lifetime": "", "first-name": "", "last-name": "", "groups": ""}
+	c, err := parseConfig(extractArgs(args, opts))
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	if opts["host"] == "" || opts["email"] == "" {
+		fmt.Fprintln(w, "--host and --email are required")
+		return 2
+	}
+	if len(c.Secret) == 0 {
+		fmt.Fprintln(w, "\"secret\" option must be set")
+		return 1
+	}
+
+	if opts["lifetime"] != "" {
+		seconds, err := strconv.Atoi(opts["lifetime"])
+		if err != nil {
+			fmt.Fprintln(w, "invalid lifetime:", err)
+			return 2
+		}
+		c.Lifetime = time.Second * time.Duration(seconds)
+	}
+
+	r := cookieRequest(opts["host"])
+	auth := NewAuth(c)
+	cookies := []*http.Cookie{auth.MakeCookie(r, opts["email"])}
+
+	if opts["first-name"] != "" || opts["last-name"] != "" || opts["groups"] != "" {
+		var sec secretsMgr
+		if err := c.loadSecrets(sec); err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+
+		user := provider.User{Email: opts["email"], FirstName: opts["first-name"], LastName: opts["last-name"]}
+		if opts["groups"] != "" {
+			user.Groups = strings.Split(opts["groups"], ",")
+		}
+		cookie, err := auth.MakeUserInfoCookie(r, user)
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return 1
+		}
+		cookies = append(cookies, cookie)
+	}
+
+	for _, cookie := range cookies {
+		fmt.Fprintf(w, "Set-Cookie: %s\n", cookie)
+	}
+	return 0
+}
+
+// cookieRequest creates a forwarded request to host, which determines the
+// cookie domain and so the cookie signature
+func cookieRequest(host string) *http.Request {
+	r := httptest.NewRequest("GET", "http://"+host+"/", nil)
+	r.Header.Set("X-Forwarded-Host", host)
+	return r
+}
@@ -0,0 +1,176 @@
+package tfa
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	setup(t)
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "test valid config",
+			args: []string{
+				"--secret=abc",
+				"--default-provider=oidc",
+				"--providers.oidc.issuer-url=https://issuer.example.com",
+				"--providers.oidc.client-id=id",
+				"--providers.oidc.client-secret=secret",
+				"--rule.public.action=allow",
+				"--rule.public.rule=PathPrefix(`/public`)",
+			},
+		},
+		{
+			name: "test rule needs json user info",
+			args: []string{
+				"--secret=abc",
+				"--default-provider=oidc",
+				"--providers.oidc.issuer-url=https://issuer.example.com",
+				"--providers.oidc.client-id=id",
+				"--providers.oidc.client-secret=secret",
+				"--rule.payroll.rule=PathPrefix(`/payroll`)",
+				"--rule.payroll.max-auth-age=900",
+				"--rule.ops.rule=PathPrefix(`/ops`)",
+				"--rule.ops.policy=contains(user.groups, \"ops\")",
+			},
+			want: []string{
+				"rule ops: max-auth-age, acr, amr and policies using user.groups need user-info-format json",
+				"rule payroll: max-auth-age, acr, amr and policies using user.groups need user-info-format json",
+			},
+		},
+		{
+			name: "test json user info",
+			args: []string{
+				"--secret=abc",
+				"--default-provider=oidc",
+				"--providers.oidc.issuer-url=https://issuer.example.com",
+				"--providers.oidc.client-id=id",
+				"--providers.oidc.client-secret=secret",
+				"--user-info-format=json",
+				"--rule.payroll.rule=PathPrefix(`/payroll`)",
+				"--rule.payroll.max-auth-age=900",
+			},
+		},
+		{
+			name: "test every problem reported",
+			args: []string{
+				"--default-provider=oidc",
+				"--rule.public.action=invalid",
+				"--rule.public.rule=PathPrefix(`/public`)",
+				"--rule.public.unknown=value",
+				"--rule.public.priority=high",
+				"--rule.public.webhook-fail-open=maybe",
+				"--rule.public.policy=user.email",
+				"--rule.public.webhook=entitlements:8080",
+				"--rule.public.max-auth-age=-1",
+				"--rule.broken.action=allow",
+				"--rule.broken.rule=PathPrefix(",
+				"--rule.broken.whitelist=/(/",
+				"--domain=/[/",
+				"--rule.net.rule=ClientIP(`nope`)",
+				"--cookie-block-key=short",
+				"--webhook-timeout=0",
+			},
+			want: []string{
+				"invalid route param: rule.public.unknown",
+				"invalid rule priority: high",
+				"invalid rule webhook-fail-open: maybe",
+				"\"secret\" option must be set",
+				"providers.oidc.issuer-url, providers.oidc.client-id, providers.oidc.client-secret must be set",
+				"\"cookie-block-key\" must be 16, 24 or 32 bytes, not 5",
+				"domain: invalid pattern \"/[/\"",
+				"\"webhook-timeout\" option must be greater than 0",
+				"rule broken: whitelist: invalid pattern \"/(/\"",
+				"rule broken: ",
+				"rule net: invalid ClientIP address \"nope\"",
+				"rule net: ",
+				"rule public: invalid rule action",
+				"rule public: invalid policy: must be a bool expression",
+				"rule public: invalid rule max-auth-age",
+				"rule public: invalid rule webhook",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := CheckConfig(tt.args, mockSecretsMgr{}, true)
+			if len(errs) != len(tt.want) {
+				t.Fatalf("CheckConfig() = %v, want %d problems", errs, len(tt.want))
+			}
+			for i, err := range errs {
+				if !strings.HasPrefix(err.Error(), tt.want[i]) {
+					t.Errorf("CheckConfig() problem %d = %v, want %v", i, err, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckConfigCommand(t *testing.T) {
+	setup(t)
+	var w bytes.Buffer
+	code := CheckConfigCommand([]string{"--offline", "--rule.public.action=invalid"}, &w)
+	if code != 1 {
+		t.Errorf("CheckConfigCommand() = %v, want 1", code)
+	}
+	if !strings.Contains(w.String(), "problem(s)") {
+		t.Errorf("CheckConfigCommand() output = %v, want problems listed", w.String())
+	}
+}
+
+func TestCookieCommand(t *testing.T) {
+	setup(t)
+	var w bytes.Buffer
+	code := CookieCommand([]string{"mint", "--secret=abc", "--host=example.com", "--email=test@example.com", "--lifetime=60"}, &w)
+	if code != 0 {
+		t.Fatalf("CookieCommand(mint) = %v, output %v", code, w.String())
+	}
+
+	value := strings.TrimPrefix(strings.SplitN(w.String(), ";", 2)[0], "Set-Cookie: _forward_auth=")
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantOut  string
+	}{
+		{
+			name:     "test valid cookie",
+			args:     []string{"decode", "--secret=abc", "--host=example.com", "--value=" + value},
+			wantCode: 0,
+			wantOut:  "Value:   test@example.com",
+		},
+		{
+			name:     "test wrong secret",
+			args:     []string{"decode", "--secret=other", "--host=example.com", "--value=" + value},
+			wantCode: 1,
+			wantOut:  "Invalid: Invalid cookie mac",
+		},
+		{
+			name:     "test missing value",
+			args:     []string{"decode", "--secret=abc", "--host=example.com"},
+			wantCode: 2,
+		},
+		{
+			name:     "test unknown command",
+			args:     []string{"eat"},
+			wantCode: 2,
+			wantOut:  "usage:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w bytes.Buffer
+			if code := CookieCommand(tt.args, &w); code != tt.wantCode {
+				t.Errorf("CookieCommand() = %v, want %v, output %v", code, tt.wantCode, w.String())
+			}
+			if !strings.Contains(w.String(), tt.wantOut) {
+				t.Errorf("CookieCommand() output = %v, want %v", w.String(), tt.wantOut)
+			}
+		})
+	}
+}
@@ -7,60 +7,97 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/containous/traefik/v2/pkg/rules"
 	"github.com/rajasoun/traefik-forward-auth/internal/provider"
 	"github.com/thomseddon/go-flags"
+	"golang.org/x/oauth2"
 )
 
-var config *Config
-
 // Config holds the runtime application config
 type Config struct {
 	LogLevel  string `long:"log-level" env:"LOG_LEVEL" default:"warn" choice:"trace" choice:"debug" choice:"info" choice:"warn" choice:"error" choice:"fatal" choice:"panic" description:"Log level"`
 	LogFormat string `long:"log-format"  env:"LOG_FORMAT" default:"text" choice:"text" choice:"json" choice:"pretty" description:"Log format"`
-
-	AuthHost               string               `long:"auth-host" env:"AUTH_HOST" description:"Single host to use when returning from 3rd party auth"`
-	Config                 func(s string) error `long:"config" env:"CONFIG" description:"Path to config file" json:"-"`
-	CookieDomains          []CookieDomain       `long:"cookie-domain" env:"COOKIE_DOMAIN" env-delim:"," description:"Domain to set auth cookie on, can be set multiple times"`
-	InsecureCookie         bool                 `long:"insecure-cookie" env:"INSECURE_COOKIE" description:"Use insecure cookies"`
-	CookieName             string               `long:"cookie-name" env:"COOKIE_NAME" default:"_forward_auth" description:"Cookie Name"`
-	UserInfoCookie         string               `long:"cookie-user" env:"COOKIE_USER" default:"_user_info" description:"User Info Cookie"`
-	CSRFCookieName         string               `long:"csrf-cookie-name" env:"CSRF_COOKIE_NAME" default:"_forward_auth_csrf" description:"CSRF Cookie Name"`
-	DefaultAction          string               `long:"default-action" env:"DEFAULT_ACTION" default:"auth" choice:"auth" choice:"allow" description:"Default action"`
-	DefaultProvider        string               `long:"default-provider" env:"DEFAULT_PROVIDER" default:"google" choice:"google" choice:"oidc" choice:"generic-oauth" description:"Default provider"`
-	Domains                CommaSeparatedList   `long:"domain" env:"DOMAIN" env-delim:"," description:"Only allow given email domains, can be set multiple times"`
-	LifetimeString         int                  `long:"lifetime" env:"LIFETIME" default:"43200" description:"Lifetime in seconds"`
-	LogoutRedirect         string               `long:"logout-redirect" env:"LOGOUT_REDIRECT" description:"URL to redirect to following logout"`
-	MatchWhitelistOrDomain bool                 `long:"match-whitelist-or-domain" env:"MATCH_WHITELIST_OR_DOMAIN" description:"Allow users that match *either* whitelist or domain (enabled by default in v3)"`
-	Path                   string               `long:"url-path" env:"URL_PATH" default:"/_oauth" description:"Callback URL Path"`
-	SecretString           string               `long:"secret" env:"SECRET" description:"Secret used for signing (required)" json:"-"`
-	Whitelist              CommaSeparatedList   `long:"whitelist" env:"WHITELIST" env-delim:"," description:"Only allow given email addresses, can be set multiple times"`
-
-	Providers provider.Providers `group:"providers" namespace:"providers" env-namespace:"PROVIDERS"`
-	Rules     map[string]*Rule   `long:"rule.<name>.<param>" description:"Rule definitions, param can be: \"action\", \"rule\" or \"provider\""`
-
-	SecretMgrAccessKey  string `long:"secret-mgr-access-key" env:"AWS_ACCESS_KEY_ID" env-delim:"," description:"AWS Secret Manager Access Key"`
-	SecretMgrSecretKey  string `long:"secret-mgr-secret-key" env:"AWS_SECRET_ACCESS_KEY" env-delim:"," description:"AWS Secret Manager Secret Key"`
-	SecretMgrRegion     string `long:"secret-mgr-region" env:"REGION" env-delim:"," description:"AWS Secret Manager Region"`
-	SecretMgrSecretName string `long:"secret-mgr-secret-name" env:"SECRET_MGR_SECRET_NAME" env-delim:"," description:"AWS Secret Manager: secret name"`
+	LogRedact string `long:"log-redact" env:"LOG_REDACT" default:"secrets" choice:"none" choice:"secrets" choice:"all" description:"Mask sensitive values in logs, \"all\" also masks email addresses"`
+
+	AllowedRedirectHosts    CommaSeparatedList   `long:"allowed-redirect-host" env:"ALLOWED_REDIRECT_HOSTS" env-delim:"," description:"Host, besides the requested host and cookie domains, users may be returned to after login, can be set multiple times"`
+	AuthHost                string               `long:"auth-host" env:"AUTH_HOST" description:"Single host to use when returning from 3rd party auth"`
+	Config                  func(s string) error `long:"config" env:"CONFIG" description:"Path to config file" json:"-"`
+	ConfigReloadInterval    int                  `long:"config-reload-interval" env:"CONFIG_RELOAD_INTERVAL" default:"10" description:"Seconds between checks of the config file for changes, 0 disables"`
+	CookieDomains           []CookieDomain       `long:"cookie-domain" env:"COOKIE_DOMAIN" env-delim:"," description:"Domain to set auth cookie on, can be set multiple times"`
+	InsecureCookie          bool                 `long:"insecure-cookie" env:"INSECURE_COOKIE" description:"Use insecure cookies"`
+	CookieName              string               `long:"cookie-name" env:"COOKIE_NAME" default:"_forward_auth" description:"Cookie Name"`
+	UserInfoCookie          string               `long:"cookie-user" env:"COOKIE_USER" default:"_user_info" description:"User Info Cookie"`
+	UserInfoFormat          string               `long:"user-info-format" env:"USER_INFO_FORMAT" default:"legacy" choice:"legacy" choice:"json" description:"Format of the user info cookie, \"legacy\" is email|first name|last name, \"json\" adds the groups and login details needed by max-auth-age, acr, amr and group policies"`
+	CSRFCookieName          string               `long:"csrf-cookie-name" env:"CSRF_COOKIE_NAME" default:"_forward_auth_csrf" description:"CSRF Cookie Name"`
+	DefaultAction           string               `long:"default-action" env:"DEFAULT_ACTION" default:"auth" choice:"auth" choice:"allow" choice:"deny" choice:"identify" description:"Default action"`
+	DefaultProvider         string               `long:"default-provider" env:"DEFAULT_PROVIDER" default:"google" choice:"google" choice:"oidc" choice:"generic-oauth" description:"Default provider"`
+	Domains                 CommaSeparatedList   `long:"domain" env:"DOMAIN" env-delim:"," description:"Only allow given email domains, can be set multiple times"`
+	LifetimeString          int                  `long:"lifetime" env:"LIFETIME" default:"43200" description:"Lifetime in seconds"`
+	LoginPage               bool                 `long:"login-page" env:"LOGIN_PAGE" description:"Show a login page instead of redirecting straight to the provider"`
+	LogoutRedirect          string               `long:"logout-redirect" env:"LOGOUT_REDIRECT" description:"URL to redirect to following logout"`
+	MatchWhitelistOrDomain  bool                 `long:"match-whitelist-or-domain" env:"MATCH_WHITELIST_OR_DOMAIN" description:"Allow users that match *either* whitelist or domain (enabled by default in v3)"`
+	Path                    string               `long:"url-path" env:"URL_PATH" default:"/_oauth" description:"Callback URL Path"`
+	ProviderCookieName      string               `long:"provider-cookie-name" env:"PROVIDER_COOKIE_NAME" default:"_forward_auth_provider" description:"Name of the cookie remembering the provider chosen by the user"`
+	SecretString            string               `long:"secret" env:"SECRET" description:"Secret used for signing (required)" json:"-" secret:"true"`
+	TemplateDir             string               `long:"template-dir" env:"TEMPLATE_DIR" description:"Directory of templates overriding the login, logout, forbidden and error pages"`
+	TrustedProxyHops        int                  `long:"trusted-proxy-hops" env:"TRUSTED_PROXY_HOPS" description:"Number of proxies in front of traefik trusted to add to X-Forwarded-For when finding the client IP"`
+	UnauthenticatedResponse string               `long:"unauthenticated-response" env:"UNAUTHENTICATED_RESPONSE" default:"auto" choice:"auto" choice:"redirect" choice:"unauthorized" description:"Response to unauthenticated requests, \"auto\" returns 401 to API requests and redirects all others"`
+	Whitelist               CommaSeparatedList   `long:"whitelist" env:"WHITELIST" env-delim:"," description:"Only allow given email addresses, can be set multiple times"`
+	WebhookTimeout          int                  `long:"webhook-timeout" env:"WEBHOOK_TIMEOUT" default:"5" description:"Seconds to wait for a rule's webhook before applying its failure mode"`
+	WebhookCacheTTL         int                  `long:"webhook-cache-ttl" env:"WEBHOOK_CACHE_TTL" default:"60" description:"Seconds to cache webhook decisions for identical requests, 0 disables"`
+
+	Providers     provider.Providers        `group:"providers" namespace:"providers" env-namespace:"PROVIDERS"`
+	Branding      Branding                  `group:"Branding" namespace:"branding" env-namespace:"BRANDING"`
+	OIDCProviders map[string]*provider.OIDC `long:"provider.<name>.<param>" description:"Additional OIDC providers, param can be: \"issuer-url\", \"client-id\", \"client-secret\", \"resource\", \"resource-uri\" or \"token-endpoint\""`
+	Rules         map[string]*Rule          `long:"rule.<name>.<param>" description:"Rule definitions, param can be: \"action\", \"rule\", \"provider\", \"providers\", \"whitelist\", \"domains\", \"unauthenticated-response\", \"priority\", \"policy\", \"webhook\", \"webhook-fail-open\", \"max-auth-age\", \"acr\" or \"amr\""`
+
+	SecretMgrAccessKey     string `long:"secret-mgr-access-key" env:"AWS_ACCESS_KEY_ID" env-delim:"," description:"AWS Secret Manager Access Key" redact:"true" secret:"true"`
+	SecretMgrSecretKey     string `long:"secret-mgr-secret-key" env:"AWS_SECRET_ACCESS_KEY" env-delim:"," description:"AWS Secret Manager Secret Key" redact:"true" secret:"true"`
+	SecretMgrSessionToken  string `long:"secret-mgr-session-token" env:"AWS_SESSION_TOKEN" description:"AWS Secret Manager Session Token, required with temporary keys" redact:"true" secret:"true"`
+	SecretMgrRegion        string `long:"secret-mgr-region" env:"REGION" env-delim:"," description:"AWS Secret Manager Region"`
+	SecretMgrSecretName    string `long:"secret-mgr-secret-name" env:"SECRET_MGR_SECRET_NAME" env-delim:"," description:"AWS Secret Manager: secret name"`
+	SecretMgrRoleARN       string `long:"secret-mgr-role-arn" env:"SECRET_MGR_ROLE_ARN" description:"ARN of an AWS role to assume when reading secrets"`
+	SecretMgrParameterName string `long:"secret-mgr-parameter-name" env:"SECRET_MGR_PARAMETER_NAME" description:"AWS SSM Parameter Store parameter to read instead of a Secret Manager secret"`
+
+	SecretsBackend         string `long:"secrets-backend" env:"SECRETS_BACKEND" default:"auto" choice:"auto" choice:"aws" choice:"vault" choice:"file" choice:"env" description:"Backend to fetch the cookie keys from, \"auto\" selects the backend whose options are set"`
+	Vault                  Vault  `group:"Vault" namespace:"vault" env-namespace:"VAULT"`
+	EncryptedSecretsFile   string `long:"encrypted-secrets-file" env:"ENCRYPTED_SECRETS_FILE" description:"Path to secrets encrypted by the \"secrets encrypt\" command"`
+	EncryptedSecretsKey    string `long:"encrypted-secrets-key" env:"ENCRYPTED_SECRETS_KEY" description:"Key the encrypted secrets file was encrypted with" json:"-" redact:"true" secret:"true"`
+	CookieHashKey          string `long:"cookie-hash-key" env:"COOKIE_HASH_KEY" description:"Key authenticating the user info cookie, read by the env secrets backend" redact:"true" secret:"true"`
+	CookieBlockKey         string `long:"cookie-block-key" env:"COOKIE_BLOCK_KEY" description:"Key encrypting the user info cookie, 16, 24 or 32 bytes, read by the env secrets backend" redact:"true" secret:"true"`
+	SecretsRefreshInterval int    `long:"secrets-refresh-interval" env:"SECRETS_REFRESH_INTERVAL" default:"300" description:"Seconds between checks of the secrets backend for rotated keys, 0 disables"`
+
+	// Filled during parsing, unknownErrs collects invalid rule params
+	// instead of failing when set
+	configFile  string
+	unknownErrs *[]error
+
+	// Filled by loadSecrets, whether the secret and client secret came from
+	// the secrets backend, so rotated values replace them
+	backendSecret       bool
+	backendClientSecret bool
 
 	// Filled during transformations
-	Secret         []byte `json:"-"`
-	Lifetime       time.Duration
-	CookieHashKey  string
-	CookieBlockKey string
+	Secret                 []byte `json:"-"`
+	Lifetime               time.Duration
+	PreviousCookieHashKey  string `redact:"true"`
+	PreviousCookieBlockKey string `redact:"true"`
 }
 
-// NewGlobalConfig creates a new global config, parsed from command arguments
-func NewGlobalConfig() *Config {
-	var err error
+// NewConfigFromArgs creates a new config, parsed from command arguments
+func NewConfigFromArgs() *Config {
 	var sec secretsMgr
-	config, err = NewConfig(os.Args[1:], sec)
+	config, err := NewConfig(os.Args[1:], sec)
 	if err != nil {
 		fmt.Printf("%+v\n", err)
 		os.Exit(1)
@@ -69,12 +106,29 @@ func NewGlobalConfig() *Config {
 	return config
 }
 
+// ParseConfig parses args into a new config and validates it, returning any
+// problem instead of exiting
+func ParseConfig(args []string) (*Config, error) {
+	var sec secretsMgr
+	config, err := NewConfig(args, sec)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.Check(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
 // TODO: move config parsing into new func "NewParsedConfig"
 
 // NewConfig parses and validates provided configuration into a config object
 func NewConfig(args []string, sec SecretsMgr) (*Config, error) {
 	c := &Config{
-		Rules: map[string]*Rule{},
+		OIDCProviders: map[string]*provider.OIDC{},
+		Rules:         map[string]*Rule{},
 	}
 
 	err := c.parseFlags(args)
@@ -87,11 +141,27 @@ func NewConfig(args []string, sec SecretsMgr) (*Config, error) {
 
 	// TODO: Rename "Validate" method to "Setup" and move all below logic
 
+	c.transform()
+
+	err = c.loadSecrets(sec)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// transform fills in the values derived from parsed options
+func (c *Config) transform() {
 	// Setup
 	// Set default provider on any rules where it's not specified
 	for _, rule := range c.Rules {
 		if rule.Provider == "" {
-			rule.Provider = c.DefaultProvider
+			if len(rule.Providers) > 0 {
+				rule.Provider = rule.Providers[0]
+			} else {
+				rule.Provider = c.DefaultProvider
+			}
 		}
 	}
 	// Transformations
@@ -100,42 +170,23 @@ func NewConfig(args []string, sec SecretsMgr) (*Config, error) {
 	}
 	c.Secret = []byte(c.SecretString)
 	c.Lifetime = time.Second * time.Duration(c.LifetimeString)
-
-	svc, err := sec.getAwsSession(c.SecretMgrAccessKey, c.SecretMgrSecretKey, c.SecretMgrRegion)
-	if err != nil {
-		return nil, err
-	}
-
-	c.CookieHashKey, c.CookieBlockKey, err = sec.getSecret(svc, c.SecretMgrSecretName)
-	if err != nil {
-		return nil, err
-	}
-
-	return c, nil
 }
 
 func (c *Config) parseFlags(args []string) error {
 	p := flags.NewParser(c, flags.Default|flags.IniUnknownOptionHandler)
-	p.UnknownOptionHandler = c.parseUnknownFlag
 
-	i := flags.NewIniParser(p)
-	c.Config = func(s string) error {
-		// Try parsing at as an ini
-		err := i.ParseFile(s)
-
-		// If it fails with a syntax error, try converting legacy to ini
-		if err != nil && strings.Contains(err.Error(), "malformed key=value") {
-			converted, convertErr := convertLegacyToIni(s)
-			if convertErr != nil {
-				// If conversion fails, return the original error
-				return err
-			}
-
-			fmt.Println("config format deprecated, please use ini format")
-			return i.Parse(converted)
-		}
+	// Remember the rule params given as flags, so they take precedence over
+	// those in the config file
+	ruleFlags := make(map[string]bool)
+	p.UnknownOptionHandler = func(option string, arg flags.SplitArgument, args []string) ([]string, error) {
+		ruleFlags[option] = true
+		return c.handleUnknownFlag(option, arg, args)
+	}
 
-		return err
+	// The config file is parsed after all flags and env vars, see parseFile
+	c.Config = func(s string) error {
+		c.configFile = s
+		return nil
 	}
 
 	_, err := p.ParseArgs(args)
@@ -143,12 +194,40 @@ func (c *Config) parseFlags(args []string) error {
 		return handleFlagError(err)
 	}
 
-	return nil
+	if err := parseSecretFileEnv(p); err != nil {
+		return err
+	}
+
+	if c.configFile != "" {
+		p.UnknownOptionHandler = c.handleUnknownFlag
+		if err := c.parseFile(p, ruleFlags); err != nil {
+			return err
+		}
+	}
+
+	return readSecretFiles(reflect.ValueOf(c).Elem())
+}
+
+// handleUnknownFlag parses an unknown flag, collecting the error rather than
+// failing the parse when unknownErrs is set
+func (c *Config) handleUnknownFlag(option string, arg flags.SplitArgument, args []string) ([]string, error) {
+	args, err := c.parseUnknownFlag(option, arg, args)
+	if err != nil && c.unknownErrs != nil {
+		*c.unknownErrs = append(*c.unknownErrs, err)
+		return args, nil
+	}
+
+	return args, err
 }
 
 func (c *Config) parseUnknownFlag(option string, arg flags.SplitArgument, args []string) ([]string, error) {
-	// Parse rules in the format "rule.<name>.<param>"
+	// Parse named providers in the format "provider.<name>.<param>"
 	parts := strings.Split(option, ".")
+	if len(parts) == 3 && parts[0] == "provider" {
+		return c.parseProviderFlag(parts[1], parts[2], arg, args)
+	}
+
+	// Parse rules in the format "rule.<name>.<param>"
 	if len(parts) == 3 && parts[0] == "rule" {
 		// Ensure there is a name
 		name := parts[1]
@@ -192,6 +271,10 @@ func (c *Config) parseUnknownFlag(option string, arg flags.SplitArgument, args [
 			rule.Rule = val
 		case "provider":
 			rule.Provider = val
+		case "providers":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.Providers = list
 		case "whitelist":
 			list := CommaSeparatedList{}
 			list.UnmarshalFlag(val)
@@ -200,6 +283,38 @@ func (c *Config) parseUnknownFlag(option string, arg flags.SplitArgument, args [
 			list := CommaSeparatedList{}
 			list.UnmarshalFlag(val)
 			rule.Domains = list
+		case "unauthenticated-response":
+			rule.UnauthenticatedResponse = val
+		case "priority":
+			priority, err := strconv.Atoi(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid rule priority: %v", val)
+			}
+			rule.Priority = priority
+		case "policy":
+			rule.Policy = val
+		case "webhook":
+			rule.Webhook = val
+		case "webhook-fail-open":
+			failOpen, err := strconv.ParseBool(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid rule webhook-fail-open: %v", val)
+			}
+			rule.WebhookFailOpen = failOpen
+		case "max-auth-age":
+			maxAuthAge, err := strconv.Atoi(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid rule max-auth-age: %v", val)
+			}
+			rule.MaxAuthAge = maxAuthAge
+		case "acr":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.ACR = list
+		case "amr":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.AMR = list
 		default:
 			return args, fmt.Errorf("invalid route param: %v", option)
 		}
@@ -210,6 +325,54 @@ func (c *Config) parseUnknownFlag(option string, arg flags.SplitArgument, args [
 	return args, nil
 }
 
+// parseProviderFlag sets a param of the named OIDC provider
+func (c *Config) parseProviderFlag(name, param string, arg flags.SplitArgument, args []string) ([]string, error) {
+	if len(name) == 0 {
+		return args, errors.New("provider name is required")
+	}
+	if name == "oidc" {
+		return args, errors.New("provider name oidc is reserved, use the providers.oidc options")
+	}
+
+	// Get value, or pop the next arg
+	val, ok := arg.Value()
+	if !ok && len(args) > 1 {
+		val = args[0]
+		args = args[1:]
+	}
+	if len(val) == 0 {
+		return args, errors.New("provider param value is required")
+	}
+
+	if c.OIDCProviders == nil {
+		c.OIDCProviders = make(map[string]*provider.OIDC)
+	}
+	p, ok := c.OIDCProviders[name]
+	if !ok {
+		p = provider.NewNamedOIDC(name)
+		c.OIDCProviders[name] = p
+	}
+
+	switch param {
+	case "issuer-url":
+		p.IssuerURL = val
+	case "client-id":
+		p.ClientID = val
+	case "client-secret":
+		p.ClientSecret = val
+	case "resource":
+		p.Resource = val
+	case "resource-uri":
+		p.APIResourceURI = val
+	case "token-endpoint":
+		p.APIAccessTokenEndpoint = val
+	default:
+		return args, fmt.Errorf("invalid provider param: provider.%s.%s", name, param)
+	}
+
+	return args, nil
+}
+
 func handleFlagError(err error) error {
 	flagsErr, ok := err.(*flags.Error)
 	if ok && flagsErr.Type == flags.ErrHelp {
@@ -233,23 +396,275 @@ func convertLegacyToIni(name string) (io.Reader, error) {
 
 // Validate validates a config object
 func (c *Config) Validate() {
+	if err := c.Check(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Check validates a config object, returning the first problem found
+func (c *Config) Check() error {
+	if errs := c.problems(false); len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+// problems validates a config object, returning every problem found. When
+// offline, providers are checked without contacting them
+func (c *Config) problems(offline bool) []error {
+	var errs []error
+
 	// Check for show stopper errors
 	if len(c.Secret) == 0 {
-		log.Fatal("\"secret\" option must be set")
+		errs = append(errs, errors.New("\"secret\" option must be set"))
+	}
+
+	// Setup default provider, and each rule provider, once
+	checked := make(map[string]bool)
+	checkProvider := func(name string) error {
+		if checked[name] {
+			return nil
+		}
+		checked[name] = true
+
+		if offline {
+			return c.validateProvider(name)
+		}
+		return c.setupProvider(name)
+	}
+
+	if err := checkProvider(c.DefaultProvider); err != nil {
+		errs = append(errs, err)
+	}
+
+	// The env backend's keys are options, so can be checked offline
+	if !offline || c.secretsBackendName() == "env" {
+		if err := validateCookieKeys(c.CookieHashKey, c.CookieBlockKey); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, err := range validatePatterns(c.Whitelist) {
+		errs = append(errs, fmt.Errorf("whitelist: %w", err))
+	}
+	for _, err := range validatePatterns(c.Domains) {
+		errs = append(errs, fmt.Errorf("domain: %w", err))
+	}
+
+	if c.WebhookTimeout <= 0 {
+		errs = append(errs, errors.New("\"webhook-timeout\" option must be greater than 0"))
 	}
 
-	// Setup default provider
-	err := c.setupProvider(c.DefaultProvider)
+	router, err := rules.NewRouter()
 	if err != nil {
-		log.Fatal(err)
+		return append(errs, err)
 	}
 
-	// Check rules (validates the rule and the rule provider)
-	for _, rule := range c.Rules {
-		err = rule.Validate(c)
-		if err != nil {
-			log.Fatal(err)
+	// Check rules (validates the rule, expression and the rule providers)
+	names := make([]string, 0, len(c.Rules))
+	for name := range c.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rule := c.Rules[name]
+		for _, err := range rule.problems() {
+			errs = append(errs, fmt.Errorf("rule %s: %w", name, err))
+		}
+
+		if c.UserInfoFormat != "json" && rule.needsUserInfo() {
+			errs = append(errs, fmt.Errorf("rule %s: max-auth-age, acr, amr and policies using user.groups need user-info-format json", name))
 		}
+
+		if err := router.AddRoute(rule.formattedRule(), 1, http.NotFoundHandler()); err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", name, err))
+		}
+
+		for _, p := range rule.providers() {
+			if err := checkProvider(p); err != nil {
+				errs = append(errs, fmt.Errorf("rule %s: %w", name, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// sortedRuleNames returns the rule names in the order they are matched, by
+// priority, highest first, and then by name
+func (c *Config) sortedRuleNames() []string {
+	names := make([]string, 0, len(c.Rules))
+	for name := range c.Rules {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := c.Rules[names[i]].Priority, c.Rules[names[j]].Priority
+		if pi != pj {
+			return pi > pj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// ruleWarnings describes overlapping rules whose order is only decided by
+// their names, as they have the same priority but different actions, so a
+// request matching both would be handled differently were either renamed
+func (c *Config) ruleWarnings() []string {
+	var warnings []string
+	names := c.sortedRuleNames()
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			ra, rb := c.Rules[a], c.Rules[b]
+			if ra.Priority != rb.Priority {
+				break
+			}
+			if ra.Action != rb.Action && rulesOverlap(ra.Rule, rb.Rule) {
+				warnings = append(warnings, fmt.Sprintf("rules %s and %s overlap and have the same priority but different actions, %s is matched first, set rule.<name>.priority to choose", a, b, a))
+			}
+		}
+	}
+	return warnings
+}
+
+var simpleMatcher = regexp.MustCompile(`^(Host|Path|PathPrefix)\(([^()]*)\)$`)
+
+// ruleMatchers are the values of a rule expression's Host, Path and
+// PathPrefix matchers, a request matches if it matches any value of each
+type ruleMatchers struct {
+	hosts    []string
+	paths    []string
+	prefixes []string
+}
+
+// parseRuleMatchers parses a rule expression of at most one Host matcher
+// and one Path or PathPrefix matcher, joined by "&&". Other expressions
+// aren't parsed, as whether they overlap can't be decided from their text
+func parseRuleMatchers(rule string) (*ruleMatchers, bool) {
+	m := &ruleMatchers{}
+	for _, part := range strings.Split(rule, "&&") {
+		sm := simpleMatcher.FindStringSubmatch(strings.TrimSpace(part))
+		if sm == nil {
+			return nil, false
+		}
+
+		var values []string
+		for _, arg := range strings.Split(sm[2], ",") {
+			arg = strings.TrimSpace(arg)
+			if len(arg) < 2 || arg[0] != '`' || arg[len(arg)-1] != '`' || strings.Contains(arg, "{") {
+				return nil, false
+			}
+			values = append(values, arg[1:len(arg)-1])
+		}
+
+		switch {
+		case sm[1] == "Host" && m.hosts == nil:
+			m.hosts = values
+		case sm[1] == "Path" && m.paths == nil && m.prefixes == nil:
+			m.paths = values
+		case sm[1] == "PathPrefix" && m.paths == nil && m.prefixes == nil:
+			m.prefixes = values
+		default:
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+// rulesOverlap checks if a request can be matched by both rule expressions,
+// reporting only those which provably overlap
+func rulesOverlap(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	ma, ok := parseRuleMatchers(a)
+	if !ok {
+		return false
+	}
+	mb, ok := parseRuleMatchers(b)
+	if !ok {
+		return false
+	}
+
+	if ma.hosts != nil && mb.hosts != nil && !anyPair(ma.hosts, mb.hosts, strings.EqualFold) {
+		return false
+	}
+
+	samePath := func(x, y string) bool { return x == y }
+	prefixed := func(x, y string) bool { return strings.HasPrefix(x, y) || strings.HasPrefix(y, x) }
+	hasPrefix := strings.HasPrefix
+	switch {
+	case ma.paths != nil && mb.paths != nil:
+		return anyPair(ma.paths, mb.paths, samePath)
+	case ma.prefixes != nil && mb.prefixes != nil:
+		return anyPair(ma.prefixes, mb.prefixes, prefixed)
+	case ma.paths != nil && mb.prefixes != nil:
+		return anyPair(ma.paths, mb.prefixes, hasPrefix)
+	case ma.prefixes != nil && mb.paths != nil:
+		return anyPair(mb.paths, ma.prefixes, hasPrefix)
+	}
+	return true
+}
+
+// anyPair checks if match is true for any pair of values from a and b
+func anyPair(a, b []string, match func(x, y string) bool) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if match(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ruleProviders returns the providers a user may log in with for the given
+// rule
+func (c *Config) ruleProviders(ruleName string) []string {
+	if rule, ok := c.Rules[ruleName]; ok {
+		return rule.providers()
+	}
+
+	return []string{c.DefaultProvider}
+}
+
+// unauthenticatedResponse returns the unauthenticated response mode for the
+// given rule, falling back to the global setting
+func (c *Config) unauthenticatedResponse(ruleName string) string {
+	if rule, ok := c.Rules[ruleName]; ok && rule.UnauthenticatedResponse != "" {
+		return rule.UnauthenticatedResponse
+	}
+
+	return c.UnauthenticatedResponse
+}
+
+// loginOptions returns the login url parameters required by the given rule
+func (c *Config) loginOptions(ruleName string) []oauth2.AuthCodeOption {
+	rule, ok := c.Rules[ruleName]
+	if !ok {
+		return nil
+	}
+
+	var opts []oauth2.AuthCodeOption
+	if rule.MaxAuthAge > 0 {
+		opts = append(opts, oauth2.SetAuthURLParam("max_age", strconv.Itoa(rule.MaxAuthAge)))
+	}
+	if len(rule.ACR) > 0 {
+		opts = append(opts, oauth2.SetAuthURLParam("acr_values", strings.Join(rule.ACR, " ")))
+	}
+	return opts
+}
+
+// LogOptions returns the logging options from the config
+func (c *Config) LogOptions() LogOptions {
+	return LogOptions{
+		Level:  c.LogLevel,
+		Format: c.LogFormat,
+		Redact: c.LogRedact,
 	}
 }
 
@@ -258,6 +673,17 @@ func (c Config) String() string {
 	return string(jsonConf)
 }
 
+// MarshalJSON encodes the config with its secrets masked, so it's safe to
+// log with any formatter
+func (c Config) MarshalJSON() ([]byte, error) {
+	// c is a copy, so masking secrets here leaves the original untouched
+	redactStruct(reflect.ValueOf(&c).Elem())
+
+	// Marshal without this method
+	type config Config
+	return json.Marshal(config(c))
+}
+
 // GetProvider returns the provider of the given name
 func (c *Config) GetProvider(name string) (provider.Provider, error) {
 	switch name {
@@ -265,6 +691,10 @@ func (c *Config) GetProvider(name string) (provider.Provider, error) {
 		return &c.Providers.OIDC, nil
 	}
 
+	if p, ok := c.OIDCProviders[name]; ok {
+		return p, nil
+	}
+
 	return nil, fmt.Errorf("Unknown provider: %s", name)
 }
 
@@ -287,7 +717,7 @@ func (c *Config) providerConfigured(name string) bool {
 
 	// Check rule providers
 	for _, rule := range c.Rules {
-		if name == rule.Provider {
+		if contains(rule.providers(), name) {
 			return true
 		}
 	}
@@ -311,13 +741,54 @@ func (c *Config) setupProvider(name string) error {
 	return nil
 }
 
+// validateProvider checks the provider exists and its options are set,
+// without contacting it
+func (c *Config) validateProvider(name string) error {
+	p, err := c.GetProvider(name)
+	if err != nil {
+		return err
+	}
+
+	if v, ok := p.(provider.Validator); ok {
+		return v.Validate()
+	}
+
+	return nil
+}
+
 // Rule holds defined rules
 type Rule struct {
 	Action    string
 	Rule      string
 	Provider  string
+	Providers CommaSeparatedList
 	Whitelist CommaSeparatedList
 	Domains   CommaSeparatedList
+
+	UnauthenticatedResponse string
+
+	// Priority orders overlapping rules, higher priorities are matched
+	// first and equal priorities are matched in order of name
+	Priority int
+
+	// Policy is an expression further restricting which of the users
+	// permitted by the whitelist and domains may access the rule's requests
+	Policy string
+
+	// Webhook is called to decide requests permitted by the rule's other
+	// checks, WebhookFailOpen allows them when it can't be reached
+	Webhook         string
+	WebhookFailOpen bool
+
+	// MaxAuthAge is the most seconds since the user last authenticated
+	// with the provider, older sessions re-authenticate, 0 allows any age
+	MaxAuthAge int
+
+	// ACR lists the authentication context classes accepted by the rule and
+	// AMR the authentication methods it requires, sessions without them
+	// step up by logging in again
+	ACR CommaSeparatedList
+	AMR CommaSeparatedList
 }
 
 // NewRule creates a new rule object
@@ -327,19 +798,90 @@ func NewRule() *Rule {
 	}
 }
 
+// needsUserInfo checks if the rule reads session details only stored in the
+// JSON user info cookie
+func (r *Rule) needsUserInfo() bool {
+	return r.MaxAuthAge > 0 || len(r.ACR) > 0 || len(r.AMR) > 0 || strings.Contains(r.Policy, "user.groups")
+}
+
 func (r *Rule) formattedRule() string {
 	// Traefik implements their own "Host" matcher and then offers "HostRegexp"
 	// to invoke the mux "Host" matcher. This ensures the mux version is used
-	return strings.ReplaceAll(r.Rule, "Host(", "HostRegexp(")
+	return formatClientIP(strings.ReplaceAll(r.Rule, "Host(", "HostRegexp("))
+}
+
+// providers returns all providers allowed by the rule
+func (r *Rule) providers() []string {
+	if len(r.Providers) > 0 {
+		return r.Providers
+	}
+
+	return []string{r.Provider}
 }
 
 // Validate validates a rule
 func (r *Rule) Validate(c *Config) error {
-	if r.Action != "auth" && r.Action != "allow" {
-		return errors.New("invalid rule action, must be \"auth\" or \"allow\"")
+	if errs := r.problems(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	for _, name := range r.providers() {
+		if err := c.setupProvider(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// problems returns every problem with the rule's own params
+func (r *Rule) problems() []error {
+	var errs []error
+
+	switch r.Action {
+	case "auth", "allow", "deny", "identify":
+	default:
+		errs = append(errs, errors.New("invalid rule action, must be \"auth\", \"allow\", \"deny\" or \"identify\""))
+	}
+
+	switch r.UnauthenticatedResponse {
+	case "", "auto", "redirect", "unauthorized":
+	default:
+		errs = append(errs, errors.New("invalid rule unauthenticated-response, must be \"auto\", \"redirect\" or \"unauthorized\""))
+	}
+
+	for _, args := range clientIPArgs(r.Rule) {
+		for _, arg := range args {
+			if _, err := parseClientNet(arg); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	for _, err := range validatePatterns(r.Whitelist) {
+		errs = append(errs, fmt.Errorf("whitelist: %w", err))
+	}
+	for _, err := range validatePatterns(r.Domains) {
+		errs = append(errs, fmt.Errorf("domains: %w", err))
+	}
+
+	if r.Policy != "" {
+		if _, err := compilePolicy(r.Policy); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if r.MaxAuthAge < 0 {
+		errs = append(errs, errors.New("invalid rule max-auth-age, must not be negative"))
+	}
+
+	if r.Webhook != "" {
+		if u, err := url.Parse(r.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid rule webhook, must be an http or https URL: %v", r.Webhook))
+		}
 	}
 
-	return c.setupProvider(r.Provider)
+	return errs
 }
 
 // Legacy support for comma separated lists
@@ -2,12 +2,17 @@ package tfa
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/rajasoun/traefik-forward-auth/internal/provider"
 )
 
@@ -26,17 +31,36 @@ func TestNewConfig(t *testing.T) {
 			name: "test empty args",
 			args: args{},
 			want: &Config{
-				LogLevel:        "warn",
-				LogFormat:       "text",
-				CookieName:      "_forward_auth",
-				UserInfoCookie:  "_user_info",
-				CSRFCookieName:  "_forward_auth_csrf",
-				DefaultAction:   "auth",
-				DefaultProvider: "google",
-				LifetimeString:  43200,
-				Path:            "/_oauth",
-				Lifetime:        43200000000000,
-				Rules:           map[string]*Rule{},
+				LogLevel:                "warn",
+				LogFormat:               "text",
+				LogRedact:               "secrets",
+				ConfigReloadInterval:    10,
+				CookieName:              "_forward_auth",
+				UserInfoCookie:          "_user_info",
+				UserInfoFormat:          "legacy",
+				CSRFCookieName:          "_forward_auth_csrf",
+				DefaultAction:           "auth",
+				DefaultProvider:         "google",
+				LifetimeString:          43200,
+				Path:                    "/_oauth",
+				ProviderCookieName:      "_forward_auth_provider",
+				UnauthenticatedResponse: "auto",
+				WebhookTimeout:          5,
+				WebhookCacheTTL:         60,
+				Lifetime:                43200000000000,
+				OIDCProviders:           map[string]*provider.OIDC{},
+				Rules:                   map[string]*Rule{},
+				Branding: Branding{
+					Title: "Traefik Forward Auth",
+					Color: "#0366d6",
+				},
+				SecretsBackend:         "auto",
+				SecretsRefreshInterval: 300,
+				CookieHashKey:          "AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+				CookieBlockKey:         "R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+				Vault: Vault{
+					Mount: "secret",
+				},
 			},
 			wantErr: false,
 		},
@@ -53,19 +77,38 @@ func TestNewConfig(t *testing.T) {
 				"--rule.1.domains=test2.com,example.org",
 				"--rule.two.action=auth",
 				"--rule.two.rule=\"Host(`two.com`) && Path(`/two`)\"",
+				"--rule.two.unauthenticated-response=unauthorized",
+				"--rule.three.providers=oidc,google",
+				"--provider.corp.issuer-url=https://idp.corp.example.com",
+				"--provider.corp.client-id=corp-client",
 			}},
 			want: &Config{
-				LogLevel:        "warn",
-				LogFormat:       "text",
-				AuthHost:        "",
-				CookieName:      "cookiename",
-				UserInfoCookie:  "_user_info",
-				CSRFCookieName:  "csrfcookiename",
-				DefaultAction:   "auth",
-				DefaultProvider: "oidc",
-				LifetimeString:  43200,
-				LogoutRedirect:  "",
-				Path:            "/_oauth",
+				LogLevel:                "warn",
+				LogFormat:               "text",
+				LogRedact:               "secrets",
+				ConfigReloadInterval:    10,
+				AuthHost:                "",
+				CookieName:              "cookiename",
+				UserInfoCookie:          "_user_info",
+				UserInfoFormat:          "legacy",
+				CSRFCookieName:          "csrfcookiename",
+				DefaultAction:           "auth",
+				DefaultProvider:         "oidc",
+				LifetimeString:          43200,
+				LogoutRedirect:          "",
+				Path:                    "/_oauth",
+				ProviderCookieName:      "_forward_auth_provider",
+				UnauthenticatedResponse: "auto",
+				WebhookTimeout:          5,
+				WebhookCacheTTL:         60,
+				OIDCProviders: map[string]*provider.OIDC{
+					"corp": func() *provider.OIDC {
+						p := provider.NewNamedOIDC("corp")
+						p.IssuerURL = "https://idp.corp.example.com"
+						p.ClientID = "corp-client"
+						return p
+					}(),
+				},
 				Rules: map[string]*Rule{
 					"1": {
 						Action:   "allow",
@@ -81,12 +124,29 @@ func TestNewConfig(t *testing.T) {
 						},
 					},
 					"two": {
-						Action:   "auth",
-						Rule:     "Host(`two.com`) \u0026\u0026 Path(`/two`)",
-						Provider: "oidc",
+						Action:                  "auth",
+						Rule:                    "Host(`two.com`) \u0026\u0026 Path(`/two`)",
+						Provider:                "oidc",
+						UnauthenticatedResponse: "unauthorized",
+					},
+					"three": {
+						Action:    "auth",
+						Provider:  "oidc",
+						Providers: []string{"oidc", "google"},
 					},
 				},
 				Lifetime: 43200000000000,
+				Branding: Branding{
+					Title: "Traefik Forward Auth",
+					Color: "#0366d6",
+				},
+				SecretsBackend:         "auto",
+				SecretsRefreshInterval: 300,
+				CookieHashKey:          "AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+				CookieBlockKey:         "R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+				Vault: Vault{
+					Mount: "secret",
+				},
 			},
 			wantErr: false,
 		},
@@ -155,20 +215,30 @@ func setup(t *testing.T) {
 	os.Setenv("PROVIDERS_OIDC_CLIENT_ID", "")
 	os.Setenv("PROVIDERS_OIDC_CLIENT_SECRET", "")
 	os.Setenv("DEFAULT_PROVIDER", "google")
+	os.Setenv("COOKIE_HASH_KEY", "AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN")
+	os.Setenv("COOKIE_BLOCK_KEY", "R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ")
 }
 
 type mockSecretsMgr struct{}
 
-func (mockSecretsMgr) getAwsSession(secretMgrAccessKey, secretMgrSecretKey, secretMgrRegion string) (secretsmanageriface.SecretsManagerAPI, error) {
+func (mockSecretsMgr) getAwsSession(secretMgrAccessKey, secretMgrSecretKey, secretMgrSessionToken, secretMgrRegion, secretMgrRoleARN string) (secretsmanageriface.SecretsManagerAPI, error) {
 	return &secretsmanager.SecretsManager{}, nil
 }
-func (mockSecretsMgr) getSecret(svc secretsmanageriface.SecretsManagerAPI, secretName string) (string, string, error) {
-	return "", "", nil
+func (mockSecretsMgr) getSecret(svc secretsmanageriface.SecretsManagerAPI, secretName string) (*Secrets, error) {
+	return &Secrets{}, nil
+}
+func (mockSecretsMgr) getSecretStage(svc secretsmanageriface.SecretsManagerAPI, secretName, versionStage string) (*Secrets, error) {
+	return &Secrets{}, nil
+}
+func (mockSecretsMgr) getSsmClient(secretMgrAccessKey, secretMgrSecretKey, secretMgrSessionToken, secretMgrRegion, secretMgrRoleARN string) (ssmiface.SSMAPI, error) {
+	return &ssm.SSM{}, nil
+}
+func (mockSecretsMgr) getParameter(svc ssmiface.SSMAPI, parameterName string) (*Secrets, error) {
+	return &Secrets{}, nil
 }
 
 func TestConfig_Validate(t *testing.T) {
 	setup(t)
-	config = &Config{}
 	type fields struct {
 		DefaultProvider string
 		Providers       provider.Providers
@@ -194,7 +264,7 @@ func TestConfig_Validate(t *testing.T) {
 				Rules: map[string]*Rule{
 					"test": {
 						Action:    "auth",
-						Rule:      "rule",
+						Rule:      "Host(`example.com`)",
 						Provider:  "oidc",
 						Whitelist: []string{"abc", "xyz"},
 						Domains:   []string{"domain1", "domain2"},
@@ -210,6 +280,9 @@ func TestConfig_Validate(t *testing.T) {
 				Providers:       tt.fields.Providers,
 				Rules:           tt.fields.Rules,
 				Secret:          tt.fields.Secret,
+				CookieHashKey:   "AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+				CookieBlockKey:  "R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+				WebhookTimeout:  5,
 			}
 			c.Validate()
 		})
@@ -291,3 +364,285 @@ func TestConfig_GetConfiguredProvider(t *testing.T) {
 		})
 	}
 }
+
+func TestNewConfig_file(t *testing.T) {
+	setup(t)
+	os.Setenv("LOG_LEVEL", "info")
+	defer os.Unsetenv("LOG_LEVEL")
+
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+	}{
+		{
+			name: "test yaml",
+			file: "config.yaml",
+			contents: `
+log-level: debug
+log-format: json
+cookie-name: file
+lifetime: 60
+insecure-cookie: true
+whitelist:
+  - a@example.com
+  - b@example.com
+providers:
+  oidc:
+    client-id: id
+rule:
+  public:
+    action: allow
+    rule: PathPrefix(` + "`/public`" + `)
+    whitelist: [c@example.com, d@example.com]
+`,
+		},
+		{
+			name: "test json",
+			file: "config.json",
+			contents: `{
+  "log-level": "debug",
+  "log-format": "json",
+  "cookie-name": "file",
+  "lifetime": 60,
+  "insecure-cookie": true,
+  "whitelist": ["a@example.com", "b@example.com"],
+  "providers": {"oidc": {"client-id": "id"}},
+  "rule": {
+    "public": {
+      "action": "allow",
+      "rule": "PathPrefix(` + "`/public`" + `)",
+      "whitelist": ["c@example.com", "d@example.com"]
+    }
+  }
+}`,
+		},
+		{
+			name: "test ini",
+			file: "config.ini",
+			contents: `
+log-level = debug
+log-format = json
+cookie-name = file
+lifetime = 60
+insecure-cookie = true
+whitelist = a@example.com
+whitelist = b@example.com
+providers.oidc.client-id = id
+rule.public.action = allow
+rule.public.rule = PathPrefix(` + "`/public`" + `)
+rule.public.whitelist = c@example.com,d@example.com
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tfa-config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, tt.file)
+			if err := ioutil.WriteFile(file, []byte(tt.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := NewConfig([]string{
+				"--cookie-name=flag",
+				"--config=" + file,
+				"--rule.public.action=auth",
+			}, mockSecretsMgr{})
+			if err != nil {
+				t.Fatalf("NewConfig() error = %v", err)
+			}
+
+			// Flags beat env vars, which beat the file, which beats defaults
+			if c.CookieName != "flag" {
+				t.Errorf("NewConfig() CookieName = %v, want flag", c.CookieName)
+			}
+			if c.LogLevel != "info" {
+				t.Errorf("NewConfig() LogLevel = %v, want info", c.LogLevel)
+			}
+			if c.LogFormat != "json" {
+				t.Errorf("NewConfig() LogFormat = %v, want json", c.LogFormat)
+			}
+			if c.Lifetime != time.Minute || !c.InsecureCookie {
+				t.Errorf("NewConfig() Lifetime = %v, InsecureCookie = %v, want 1m0s, true", c.Lifetime, c.InsecureCookie)
+			}
+			if want := (CommaSeparatedList{"a@example.com", "b@example.com"}); !reflect.DeepEqual(c.Whitelist, want) {
+				t.Errorf("NewConfig() Whitelist = %v, want %v", c.Whitelist, want)
+			}
+			if c.Providers.OIDC.ClientID != "id" {
+				t.Errorf("NewConfig() OIDC.ClientID = %v, want id", c.Providers.OIDC.ClientID)
+			}
+			want := &Rule{
+				Action:    "auth",
+				Rule:      "PathPrefix(`/public`)",
+				Provider:  "google",
+				Whitelist: CommaSeparatedList{"c@example.com", "d@example.com"},
+			}
+			if !reflect.DeepEqual(c.Rules["public"], want) {
+				t.Errorf("NewConfig() rule = %+v, want %+v", c.Rules["public"], want)
+			}
+		})
+	}
+}
+
+func TestNewConfig_secretFiles(t *testing.T) {
+	setup(t)
+	dir, err := ioutil.TempDir("", "tfa-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "secret")
+	clientSecretFile := filepath.Join(dir, "client-secret")
+	ioutil.WriteFile(secretFile, []byte("file-secret\n"), 0600)
+	ioutil.WriteFile(clientSecretFile, []byte("file-client-secret"), 0600)
+
+	tests := []struct {
+		name             string
+		args             []string
+		env              map[string]string
+		wantSecret       string
+		wantClientSecret string
+		wantCorpSecret   string
+		wantErr          bool
+	}{
+		{
+			name:       "test file url",
+			args:       []string{"--secret=file://" + secretFile},
+			wantSecret: "file-secret",
+		},
+		{
+			name: "test file env vars",
+			env: map[string]string{
+				"SECRET_FILE":                       secretFile,
+				"PROVIDERS_OIDC_CLIENT_SECRET_FILE": clientSecretFile,
+			},
+			wantSecret:       "file-secret",
+			wantClientSecret: "file-client-secret",
+		},
+		{
+			name:       "test flag overrides file env var",
+			args:       []string{"--secret=flag-secret"},
+			env:        map[string]string{"SECRET_FILE": secretFile},
+			wantSecret: "flag-secret",
+		},
+		{
+			name:           "test named provider file url",
+			args:           []string{"--provider.corp.client-secret=file://" + clientSecretFile},
+			wantCorpSecret: "file-client-secret",
+		},
+		{
+			name:    "test missing file",
+			args:    []string{"--secret=file://" + filepath.Join(dir, "missing")},
+			wantErr: true,
+		},
+		{
+			name:    "test named provider missing file",
+			args:    []string{"--provider.corp.client-secret=file://" + filepath.Join(dir, "missing")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+
+			c, err := NewConfig(tt.args, mockSecretsMgr{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if string(c.Secret) != tt.wantSecret {
+				t.Errorf("NewConfig() Secret = %q, want %q", c.Secret, tt.wantSecret)
+			}
+			if c.Providers.OIDC.ClientSecret != tt.wantClientSecret {
+				t.Errorf("NewConfig() ClientSecret = %q, want %q", c.Providers.OIDC.ClientSecret, tt.wantClientSecret)
+			}
+			var corpSecret string
+			if p, ok := c.OIDCProviders["corp"]; ok {
+				corpSecret = p.ClientSecret
+			}
+			if corpSecret != tt.wantCorpSecret {
+				t.Errorf("NewConfig() provider.corp.client-secret = %q, want %q", corpSecret, tt.wantCorpSecret)
+			}
+		})
+	}
+}
+
+func TestConfig_ruleWarnings(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules map[string]*Rule
+		want  []string
+	}{
+		{
+			name: "test same action",
+			rules: map[string]*Rule{
+				"one": {Action: "auth"},
+				"two": {Action: "auth"},
+			},
+		},
+		{
+			name: "test different priorities",
+			rules: map[string]*Rule{
+				"one": {Action: "allow", Priority: 2},
+				"two": {Action: "deny", Priority: 1},
+			},
+		},
+		{
+			name: "test same priority different actions",
+			rules: map[string]*Rule{
+				"one":   {Action: "allow"},
+				"two":   {Action: "deny"},
+				"three": {Action: "deny", Priority: 5},
+			},
+			want: []string{
+				"rules one and two overlap and have the same priority but different actions, one is matched first, set rule.<name>.priority to choose",
+			},
+		},
+		{
+			name: "test overlapping matchers",
+			rules: map[string]*Rule{
+				"api":   {Action: "allow", Rule: "PathPrefix(`/api`)"},
+				"admin": {Action: "deny", Rule: "Host(`example.com`) && PathPrefix(`/api/admin`)"},
+				"login": {Action: "allow", Rule: "Host(`EXAMPLE.com`) && Path(`/api/admin/login`)"},
+			},
+			want: []string{
+				"rules admin and api overlap and have the same priority but different actions, admin is matched first, set rule.<name>.priority to choose",
+				"rules admin and login overlap and have the same priority but different actions, admin is matched first, set rule.<name>.priority to choose",
+			},
+		},
+		{
+			name: "test non-overlapping matchers",
+			rules: map[string]*Rule{
+				"api":    {Action: "allow", Rule: "PathPrefix(`/api`)"},
+				"web":    {Action: "deny", Rule: "PathPrefix(`/web`, `/static`)"},
+				"other":  {Action: "auth", Rule: "Host(`other.example.com`) && PathPrefix(`/docs`)"},
+				"public": {Action: "allow", Rule: "Host(`example.com`) && Path(`/public`)"},
+			},
+		},
+		{
+			name: "test matchers which can't be compared",
+			rules: map[string]*Rule{
+				"api":  {Action: "allow", Rule: "PathPrefix(`/api`)"},
+				"ip":   {Action: "deny", Rule: "ClientIP(`10.0.0.0/8`)"},
+				"post": {Action: "deny", Rule: "Method(`POST`) && PathPrefix(`/api`)"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Rules: tt.rules}
+			if got := c.ruleWarnings(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Config.ruleWarnings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
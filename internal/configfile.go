@@ -0,0 +1,302 @@
+package tfa
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thomseddon/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+// fileOption is an option read from a config file, named as the flag
+type fileOption struct {
+	Name  string
+	Value string
+}
+
+// parseFile applies the options in the config file to the parser. File
+// options only fill in those not given as a flag or non-empty env var,
+// including the "_FILE" env vars of secrets, so the precedence is:
+// flags > env vars > config file > defaults
+func (c *Config) parseFile(p *flags.Parser, ruleFlags map[string]bool) error {
+	opts, err := readConfigFile(c.configFile)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, o := range opts {
+		// Config files can't include another
+		if o.Name == "config" || ruleFlags[o.Name] {
+			continue
+		}
+
+		if opt := p.FindOptionByLongName(o.Name); opt != nil && envSet(opt) {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "%s = %s\n", o.Name, strconv.Quote(o.Value))
+	}
+
+	// Parsing as defaults skips any option set by a flag
+	i := flags.NewIniParser(p)
+	i.ParseAsDefaults = true
+	return i.Parse(&buf)
+}
+
+// readConfigFile reads the options in a YAML, JSON or ini config file,
+// detected by extension
+func readConfigFile(name string) ([]fileOption, error) {
+	var v interface{}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	case ".json":
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	default:
+		return readIniFile(name)
+	}
+
+	// An empty file has no options
+	if v == nil {
+		return nil, nil
+	}
+
+	var opts []fileOption
+	if err := flattenConfig("", v, &opts); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return opts, nil
+}
+
+// readIniFile reads the options in an ini config file, falling back to the
+// legacy "key value" format
+func readIniFile(name string) ([]fileOption, error) {
+	var opts []fileOption
+
+	// Every option is unknown to an empty parser, so all are collected
+	p := flags.NewParser(&struct{}{}, flags.IniUnknownOptionHandler)
+	p.UnknownOptionHandler = func(option string, arg flags.SplitArgument, args []string) ([]string, error) {
+		val, _ := arg.Value()
+		opts = append(opts, fileOption{option, val})
+		return args, nil
+	}
+
+	i := flags.NewIniParser(p)
+	err := i.ParseFile(name)
+
+	// If it fails with a syntax error, try converting legacy to ini
+	if err != nil && strings.Contains(err.Error(), "malformed key=value") {
+		converted, convertErr := convertLegacyToIni(name)
+		if convertErr != nil {
+			// If conversion fails, return the original error
+			return nil, err
+		}
+
+		fmt.Println("config format deprecated, please use ini format")
+		opts = nil
+		err = i.Parse(converted)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// flattenConfig converts nested YAML or JSON values into options named as
+// the flags, so "providers: {oidc: {client-id: x}}" becomes
+// "providers.oidc.client-id". Lists become one option per item, other than
+// rule params which take a comma separated list
+func flattenConfig(prefix string, v interface{}, opts *[]fileOption) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if err := flattenConfig(joinKey(prefix, k), v[k], opts); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = val
+		}
+		return flattenConfig(prefix, m, opts)
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			s, err := scalarString(prefix, item)
+			if err != nil {
+				return err
+			}
+			items = append(items, s)
+		}
+
+		if strings.HasPrefix(prefix, "rule.") {
+			*opts = append(*opts, fileOption{prefix, strings.Join(items, ",")})
+		} else {
+			for _, item := range items {
+				*opts = append(*opts, fileOption{prefix, item})
+			}
+		}
+	case nil:
+		// Options without a value are left unset
+	default:
+		s, err := scalarString(prefix, v)
+		if err != nil {
+			return err
+		}
+		*opts = append(*opts, fileOption{prefix, s})
+	}
+
+	return nil
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// scalarString formats a YAML or JSON scalar as it would be given as a flag
+func scalarString(name string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+
+	return "", fmt.Errorf("invalid value for %s: %v", name, v)
+}
+
+// envSet determines if the option was given as a non-empty env var
+func envSet(opt *flags.Option) bool {
+	key := opt.EnvKeyWithNamespace()
+	if key == "" {
+		return false
+	}
+
+	if isSecret(opt) && os.Getenv(key+"_FILE") != "" {
+		return true
+	}
+	return os.Getenv(key) != ""
+}
+
+func isSecret(opt *flags.Option) bool {
+	return opt.Field().Tag.Get("secret") == "true"
+}
+
+// parseSecretFileEnv sets each secret given by a "<env var>_FILE" env var,
+// unless given as a flag or the env var itself, to be read from the file
+func parseSecretFileEnv(p *flags.Parser) error {
+	var buf bytes.Buffer
+	eachOption(p.Groups(), func(opt *flags.Option) {
+		key := opt.EnvKeyWithNamespace()
+		if !isSecret(opt) || key == "" || os.Getenv(key) != "" {
+			return
+		}
+
+		if file := os.Getenv(key + "_FILE"); file != "" {
+			fmt.Fprintf(&buf, "%s = %s\n", opt.LongNameWithNamespace(), strconv.Quote(secretFilePrefix+file))
+		}
+	})
+
+	// Parsing as defaults skips any option set by a flag
+	i := flags.NewIniParser(p)
+	i.ParseAsDefaults = true
+	return i.Parse(&buf)
+}
+
+func eachOption(groups []*flags.Group, f func(*flags.Option)) {
+	for _, g := range groups {
+		for _, opt := range g.Options() {
+			f(opt)
+		}
+		eachOption(g.Groups(), f)
+	}
+}
+
+const secretFilePrefix = "file://"
+
+// readSecretFiles replaces the value of each secret given as
+// "file:///path/to/file" with the contents of the file, so secrets need not
+// appear in flags or env vars. Secrets of named options, such as
+// provider.<name>.client-secret, are read from the map's structs
+func readSecretFiles(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+
+		switch f.Kind() {
+		case reflect.Struct:
+			if err := readSecretFiles(f); err != nil {
+				return err
+			}
+		case reflect.Map:
+			if f.Type().Key().Kind() != reflect.String || f.Type().Elem().Kind() != reflect.Ptr ||
+				f.Type().Elem().Elem().Kind() != reflect.Struct {
+				continue
+			}
+
+			long := strings.TrimSuffix(t.Field(i).Tag.Get("long"), "<param>")
+			iter := f.MapRange()
+			for iter.Next() {
+				if iter.Value().IsNil() {
+					continue
+				}
+				if err := readSecretFiles(iter.Value().Elem()); err != nil {
+					return fmt.Errorf("%s%w", strings.Replace(long, "<name>", iter.Key().String(), 1), err)
+				}
+			}
+		case reflect.String:
+			if t.Field(i).Tag.Get("secret") != "true" || !strings.HasPrefix(f.String(), secretFilePrefix) {
+				continue
+			}
+
+			b, err := ioutil.ReadFile(strings.TrimPrefix(f.String(), secretFilePrefix))
+			if err != nil {
+				return fmt.Errorf("%s: %w", t.Field(i).Tag.Get("long"), err)
+			}
+			f.SetString(strings.TrimRight(string(b), "\r\n"))
+		}
+	}
+
+	return nil
+}
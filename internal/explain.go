@@ -0,0 +1,202 @@
+package tfa
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// Explanation describes how a forwarded request would be handled
+type Explanation struct {
+	Rule       string
+	Expression string
+	Action     string
+	Providers  []string
+	Decision   string
+	Reasons    []string
+}
+
+// Explain runs a simulated forwarded request from the client ip, if not
+// empty, through the same router as real requests, describing the rule
+// matched and the decision made for the given email, or for a request
+// without a session if email is empty
+func (s *Server) Explain(method, host, uri, ip, email string) (*Explanation, error) {
+	e := &Explanation{}
+
+	router, err := s.newRouter(func(name string, rule *Rule) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e.Rule = name
+			e.Expression = rule.formattedRule()
+			e.Action = rule.Action
+			if rule.Action == "auth" || rule.Action == "identify" {
+				e.Providers = s.config.ruleProviders(name)
+			}
+		})
+	}, func(path string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e.Rule = s.config.Path + path
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := httptest.NewRequest(method, "http://"+host+uri, nil)
+	if ip != "" {
+		r.Header.Set("X-Forwarded-For", ip)
+	}
+	s.setClientNetHeaders(r)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	switch {
+	case e.Action == "":
+		e.Decision = "handled by forward auth"
+		e.Reasons = append(e.Reasons, fmt.Sprintf("%s is a forward auth path", e.Rule))
+	case e.Action == "allow":
+		e.Decision = "allow"
+		e.Reasons = append(e.Reasons, "rule allows all requests")
+	case e.Action == "deny":
+		e.Decision = "deny"
+		e.Reasons = append(e.Reasons, "rule denies all requests")
+	case e.Action == "identify":
+		e.Decision = "allow"
+		switch {
+		case email == "":
+			e.Reasons = append(e.Reasons, "no session, request is allowed without a user")
+		case !s.auth.ValidateEmail(email, e.Rule):
+			e.Reasons = append(e.Reasons, fmt.Sprintf("%s is not permitted, request is allowed without a user", email))
+		default:
+			e.Reasons = append(e.Reasons, fmt.Sprintf("%s is identified", email))
+		}
+	case email == "":
+		e.Decision = "login"
+		if len(e.Providers) > 1 {
+			e.Reasons = append(e.Reasons, "no session, user chooses a provider to log in with")
+		} else {
+			e.Reasons = append(e.Reasons, fmt.Sprintf("no session, user is sent to %s to log in", e.Providers[0]))
+		}
+	case !s.auth.ValidateEmail(email, e.Rule):
+		e.Decision = "forbidden"
+		e.Reasons = append(e.Reasons, fmt.Sprintf("%s is not permitted", email))
+	case !s.policyAllows(e.Rule, r, email):
+		e.Decision = "forbidden"
+		e.Reasons = append(e.Reasons, fmt.Sprintf("%s is not permitted by the rule policy", email))
+	default:
+		e.Decision = "allow"
+		e.Reasons = append(e.Reasons, fmt.Sprintf("%s is permitted", email))
+	}
+
+	if e.Action == "auth" {
+		rule := s.config.Rules[e.Rule]
+		if rule == nil {
+			rule = s.defaultRule()
+		}
+
+		whitelist, domains := s.config.Whitelist, s.config.Domains
+		if len(rule.Whitelist) > 0 || len(rule.Domains) > 0 {
+			whitelist, domains = rule.Whitelist, rule.Domains
+			e.Reasons = append(e.Reasons, "rule whitelist and domains replace the global ones")
+		}
+		if len(whitelist) == 0 && len(domains) == 0 {
+			e.Reasons = append(e.Reasons, "no whitelist or domains, any logged in user is permitted")
+		}
+		if len(whitelist) > 0 {
+			e.Reasons = append(e.Reasons, "whitelist: "+strings.Join(whitelist, ", "))
+		}
+		if len(domains) > 0 {
+			e.Reasons = append(e.Reasons, "domains: "+strings.Join(domains, ", "))
+		}
+		if rule.Policy != "" {
+			e.Reasons = append(e.Reasons, "policy: "+rule.Policy)
+		}
+		if rule.Webhook != "" {
+			e.Reasons = append(e.Reasons, "webhook decides permitted requests: "+rule.Webhook)
+		}
+		if rule.MaxAuthAge > 0 {
+			e.Reasons = append(e.Reasons, fmt.Sprintf("sessions logged in over %d seconds ago log in again", rule.MaxAuthAge))
+		}
+		if len(rule.ACR) > 0 {
+			e.Reasons = append(e.Reasons, "sessions step up unless their acr is one of: "+strings.Join(rule.ACR, ", "))
+		}
+		if len(rule.AMR) > 0 {
+			e.Reasons = append(e.Reasons, "sessions step up unless their amr includes: "+strings.Join(rule.AMR, ", "))
+		}
+	}
+
+	return e, nil
+}
+
+// ExplainCommand runs the explain command, describing to w how the request
+// given by args would be handled and returning the exit code
+func ExplainCommand(args []string, w io.Writer) int {
+	opts := map[string]string{"method": "GET", "host": "", "uri": "/", "ip": "", "email": ""}
+	configArgs := extractArgs(args, opts)
+
+	if opts["host"] == "" {
+		fmt.Fprintln(w, "--host is required")
+		return 2
+	}
+
+	c, err := parseConfig(configArgs)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+
+	s, err := NewServer(c, nil)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+
+	e, err := s.Explain(opts["method"], opts["host"], opts["uri"], opts["ip"], opts["email"])
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+
+	fmt.Fprintf(w, "Rule:       %s\n", e.Rule)
+	if e.Expression != "" {
+		fmt.Fprintf(w, "Expression: %s\n", e.Expression)
+	}
+	if e.Action != "" {
+		fmt.Fprintf(w, "Action:     %s\n", e.Action)
+	}
+	if len(e.Providers) > 0 {
+		fmt.Fprintf(w, "Providers:  %s\n", strings.Join(e.Providers, ", "))
+	}
+	fmt.Fprintf(w, "Decision:   %s\n", e.Decision)
+	for _, reason := range e.Reasons {
+		fmt.Fprintf(w, "  - %s\n", reason)
+	}
+	return 0
+}
+
+// extractArgs removes the "--name=value" or "--name value" args named in
+// opts, storing their values in opts, and returns the remaining args
+func extractArgs(args []string, opts map[string]string) []string {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimPrefix(args[i], "--")
+		value := ""
+		hasValue := false
+		if parts := strings.SplitN(name, "=", 2); len(parts) == 2 {
+			name, value, hasValue = parts[0], parts[1], true
+		}
+
+		if _, ok := opts[name]; !ok || !strings.HasPrefix(args[i], "--") {
+			rest = append(rest, args[i])
+			continue
+		}
+
+		if !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		opts[name] = value
+	}
+
+	return rest
+}
@@ -0,0 +1,191 @@
+package tfa
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestServer_Explain(t *testing.T) {
+	config := &Config{
+		Path:            "/_oauth",
+		DefaultAction:   "auth",
+		DefaultProvider: "oidc",
+		Domains:         []string{"example.com"},
+		Rules: map[string]*Rule{
+			"public": {
+				Action: "allow",
+				Rule:   "Host(`app.example.com`) && PathPrefix(`/public`)",
+			},
+			"blocked": {
+				Action:   "deny",
+				Rule:     "PathPrefix(`/public/blocked`)",
+				Priority: 1,
+			},
+			"monitoring": {
+				Action: "allow",
+				Rule:   "Path(`/health`) && ClientIP(`10.1.0.0/16`)",
+			},
+			"admin": {
+				Action:    "auth",
+				Rule:      "PathPrefix(`/admin`)",
+				Provider:  "oidc",
+				Providers: []string{"oidc", "google"},
+				Whitelist: []string{"admin@example.com"},
+			},
+			"reports": {
+				Action:   "auth",
+				Rule:     "PathPrefix(`/reports`)",
+				Provider: "oidc",
+				Policy:   `request.method == "POST"`,
+			},
+			"home": {
+				Action:   "identify",
+				Rule:     "PathPrefix(`/home`)",
+				Provider: "oidc",
+			},
+		},
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		uri          string
+		ip           string
+		email        string
+		wantRule     string
+		wantDecision string
+		wantReasons  []string
+	}{
+		{
+			name:         "test allow rule",
+			uri:          "/public/page",
+			wantRule:     "public",
+			wantDecision: "allow",
+			wantReasons:  []string{"rule allows all requests"},
+		},
+		{
+			name:         "test deny rule",
+			uri:          "/public/blocked",
+			wantRule:     "blocked",
+			wantDecision: "deny",
+			wantReasons:  []string{"rule denies all requests"},
+		},
+		{
+			name:         "test default rule without session",
+			uri:          "/page",
+			wantRule:     "default",
+			wantDecision: "login",
+			wantReasons:  []string{"no session, user is sent to oidc to log in", "domains: example.com"},
+		},
+		{
+			name:         "test default rule permitted",
+			uri:          "/page",
+			email:        "user@example.com",
+			wantRule:     "default",
+			wantDecision: "allow",
+			wantReasons:  []string{"user@example.com is permitted", "domains: example.com"},
+		},
+		{
+			name:         "test rule whitelist",
+			uri:          "/admin",
+			email:        "user@example.com",
+			wantRule:     "admin",
+			wantDecision: "forbidden",
+			wantReasons: []string{
+				"user@example.com is not permitted",
+				"rule whitelist and domains replace the global ones",
+				"whitelist: admin@example.com",
+			},
+		},
+		{
+			name:         "test rule policy",
+			uri:          "/reports",
+			email:        "user@example.com",
+			wantRule:     "reports",
+			wantDecision: "forbidden",
+			wantReasons: []string{
+				"user@example.com is not permitted by the rule policy",
+				"domains: example.com",
+				`policy: request.method == "POST"`,
+			},
+		},
+		{
+			name:         "test identify rule without session",
+			uri:          "/home",
+			wantRule:     "home",
+			wantDecision: "allow",
+			wantReasons:  []string{"no session, request is allowed without a user"},
+		},
+		{
+			name:         "test identify rule identified",
+			uri:          "/home",
+			email:        "user@example.com",
+			wantRule:     "home",
+			wantDecision: "allow",
+			wantReasons:  []string{"user@example.com is identified"},
+		},
+		{
+			name:         "test multiple providers",
+			uri:          "/admin",
+			wantRule:     "admin",
+			wantDecision: "login",
+			wantReasons: []string{
+				"no session, user chooses a provider to log in with",
+				"rule whitelist and domains replace the global ones",
+				"whitelist: admin@example.com",
+			},
+		},
+		{
+			name:         "test client ip rule",
+			uri:          "/health",
+			ip:           "10.1.2.3",
+			wantRule:     "monitoring",
+			wantDecision: "allow",
+			wantReasons:  []string{"rule allows all requests"},
+		},
+		{
+			name:         "test client ip rule not matched",
+			uri:          "/health",
+			ip:           "10.2.2.3",
+			wantRule:     "default",
+			wantDecision: "login",
+			wantReasons:  []string{"no session, user is sent to oidc to log in", "domains: example.com"},
+		},
+		{
+			name:         "test forward auth path",
+			uri:          "/_oauth/logout",
+			wantRule:     "/_oauth/logout",
+			wantDecision: "handled by forward auth",
+			wantReasons:  []string{"/_oauth/logout is a forward auth path"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Explain("GET", "app.example.com", tt.uri, tt.ip, tt.email)
+			if err != nil {
+				t.Fatalf("Server.Explain() error = %v", err)
+			}
+			if got.Rule != tt.wantRule || got.Decision != tt.wantDecision {
+				t.Errorf("Server.Explain() = %v, %v, want %v, %v", got.Rule, got.Decision, tt.wantRule, tt.wantDecision)
+			}
+			if !reflect.DeepEqual(got.Reasons, tt.wantReasons) {
+				t.Errorf("Server.Explain() reasons = %q, want %q", got.Reasons, tt.wantReasons)
+			}
+		})
+	}
+}
+
+func Test_extractArgs(t *testing.T) {
+	opts := map[string]string{"host": "", "uri": "/"}
+	rest := extractArgs([]string{"--host=example.com", "--secret=abc", "--uri", "/path", "--rule.1.action=allow"}, opts)
+
+	if want := []string{"--secret=abc", "--rule.1.action=allow"}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("extractArgs() = %v, want %v", rest, want)
+	}
+	if want := map[string]string{"host": "example.com", "uri": "/path"}; !reflect.DeepEqual(opts, want) {
+		t.Errorf("extractArgs() opts = %v, want %v", opts, want)
+	}
+}
@@ -6,16 +6,23 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-var log *logrus.Logger
+var log = logrus.StandardLogger()
 
-// NewDefaultLogger creates a new logger based on the current configuration
-func NewDefaultLogger() *logrus.Logger {
+// LogOptions control the format, level and redaction of log output
+type LogOptions struct {
+	Level  string
+	Format string
+	Redact string
+}
+
+// NewDefaultLogger configures the default logger with the given options
+func NewDefaultLogger(opts LogOptions) *logrus.Logger {
 	// Setup logger
 	log = logrus.StandardLogger()
 	logrus.SetOutput(os.Stdout)
 
 	// Set logger format
-	switch config.LogFormat {
+	switch opts.Format {
 	case "pretty":
 		break
 	case "json":
@@ -28,8 +35,12 @@ func NewDefaultLogger() *logrus.Logger {
 		})
 	}
 
+	// Mask secrets in all log output
+	log.ReplaceHooks(make(logrus.LevelHooks))
+	log.AddHook(NewRedactHook(opts.Redact))
+
 	// Set logger level
-	switch config.LogLevel {
+	switch opts.Level {
 	case "trace":
 		logrus.SetLevel(logrus.TraceLevel)
 	case "debug":
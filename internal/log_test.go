@@ -104,8 +104,7 @@ func TestNewDefaultLogger(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			config = tt.config
-			if got := NewDefaultLogger(); !reflect.DeepEqual(got.Level, tt.want) ||
+			if got := NewDefaultLogger(tt.config.LogOptions()); !reflect.DeepEqual(got.Level, tt.want) ||
 				reflect.TypeOf(got.Formatter) != reflect.TypeOf(tt.fmtr) {
 				t.Errorf("NewDefaultLogger() = %v, want %v", got.Level, tt.want)
 			}
@@ -0,0 +1,80 @@
+package tfa
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// compiledPattern is a cached compilation of a whitelist or domain entry,
+// re is nil for entries compared exactly
+type compiledPattern struct {
+	re  *regexp.Regexp
+	err error
+}
+
+var patternCache sync.Map
+
+// compilePattern compiles a whitelist or domain entry, caching the result.
+// Entries wrapped in slashes, as "/regex/", are regular expressions
+// anchored to the whole value, entries containing "*" or "?" are globs, and
+// all others are compared exactly. Matching ignores case
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if cached, ok := patternCache.Load(pattern); ok {
+		c := cached.(compiledPattern)
+		return c.re, c.err
+	}
+
+	var c compiledPattern
+	switch {
+	case len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		c.re, c.err = regexp.Compile("^(?i:" + pattern[1:len(pattern)-1] + ")$")
+	case strings.ContainsAny(pattern, "*?"):
+		glob := regexp.QuoteMeta(pattern)
+		glob = strings.ReplaceAll(glob, `\*`, ".*")
+		glob = strings.ReplaceAll(glob, `\?`, ".")
+		c.re, c.err = regexp.Compile("^(?i:" + glob + ")$")
+	}
+	if c.err != nil {
+		c.err = fmt.Errorf("invalid pattern %q: %w", pattern, c.err)
+	}
+
+	patternCache.Store(pattern, c)
+	return c.re, c.err
+}
+
+// matchPattern checks if value matches the whitelist or domain entry
+func matchPattern(pattern, value string) bool {
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return false
+	}
+	if re == nil {
+		return strings.EqualFold(pattern, value)
+	}
+	return re.MatchString(value)
+}
+
+// matchDomain checks if domain matches the domains entry, where an entry
+// with a leading dot, as ".example.com", matches the domain and all of its
+// subdomains
+func matchDomain(pattern, domain string) bool {
+	if strings.HasPrefix(pattern, ".") && !strings.ContainsAny(pattern, "*?") {
+		domain = strings.ToLower(domain)
+		pattern = strings.ToLower(pattern)
+		return domain == pattern[1:] || strings.HasSuffix(domain, pattern)
+	}
+	return matchPattern(pattern, domain)
+}
+
+// validatePatterns checks that each whitelist or domain entry compiles
+func validatePatterns(patterns []string) []error {
+	var errs []error
+	for _, p := range patterns {
+		if _, err := compilePattern(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,184 @@
+package tfa
+
+import (
+	"testing"
+)
+
+func TestValidateWhitelist(t *testing.T) {
+	tests := []struct {
+		name      string
+		email     string
+		whitelist CommaSeparatedList
+		want      bool
+	}{
+		{
+			name:      "test exact",
+			email:     "test@example.com",
+			whitelist: CommaSeparatedList{"test@example.com"},
+			want:      true,
+		},
+		{
+			name:      "test exact ignores case",
+			email:     "Test@Example.com",
+			whitelist: CommaSeparatedList{"test@example.com"},
+			want:      true,
+		},
+		{
+			name:      "test glob",
+			email:     "svc-deploy@example.com",
+			whitelist: CommaSeparatedList{"svc-*@example.com"},
+			want:      true,
+		},
+		{
+			name:      "test glob is anchored",
+			email:     "svc-deploy@example.com.evil.com",
+			whitelist: CommaSeparatedList{"svc-*@example.com"},
+			want:      false,
+		},
+		{
+			name:      "test glob single character",
+			email:     "user1@example.com",
+			whitelist: CommaSeparatedList{"user?@example.com"},
+			want:      true,
+		},
+		{
+			name:      "test glob dots are literal",
+			email:     "testXexample@example.com",
+			whitelist: CommaSeparatedList{"test.example*"},
+			want:      false,
+		},
+		{
+			name:      "test regex",
+			email:     "ops-42@example.com",
+			whitelist: CommaSeparatedList{`/ops-\d+@example\.com/`},
+			want:      true,
+		},
+		{
+			name:      "test regex is anchored",
+			email:     "ops-42@example.com.evil.com",
+			whitelist: CommaSeparatedList{`/ops-\d+@example\.com/`},
+			want:      false,
+		},
+		{
+			name:      "test invalid regex never matches",
+			email:     "test@example.com",
+			whitelist: CommaSeparatedList{"/(/"},
+			want:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidateWhitelist(tt.email, tt.whitelist); got != tt.want {
+				t.Errorf("ValidateWhitelist() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDomains(t *testing.T) {
+	tests := []struct {
+		name    string
+		email   string
+		domains CommaSeparatedList
+		want    bool
+	}{
+		{
+			name:    "test exact",
+			email:   "test@example.com",
+			domains: CommaSeparatedList{"example.com"},
+			want:    true,
+		},
+		{
+			name:    "test exact ignores case",
+			email:   "test@EXAMPLE.com",
+			domains: CommaSeparatedList{"example.com"},
+			want:    true,
+		},
+		{
+			name:    "test exact excludes subdomains",
+			email:   "test@eu.example.com",
+			domains: CommaSeparatedList{"example.com"},
+			want:    false,
+		},
+		{
+			name:    "test leading dot includes domain",
+			email:   "test@example.com",
+			domains: CommaSeparatedList{".example.com"},
+			want:    true,
+		},
+		{
+			name:    "test leading dot includes subdomains",
+			email:   "test@eu.Example.com",
+			domains: CommaSeparatedList{".example.com"},
+			want:    true,
+		},
+		{
+			name:    "test leading dot excludes suffixes",
+			email:   "test@notexample.com",
+			domains: CommaSeparatedList{".example.com"},
+			want:    false,
+		},
+		{
+			name:    "test wildcard subdomains",
+			email:   "test@eu.example.com",
+			domains: CommaSeparatedList{"*.example.com"},
+			want:    true,
+		},
+		{
+			name:    "test wildcard excludes domain",
+			email:   "test@example.com",
+			domains: CommaSeparatedList{"*.example.com"},
+			want:    false,
+		},
+		{
+			name:    "test regex",
+			email:   "test@eu1.example.com",
+			domains: CommaSeparatedList{`/(eu|us)\d\.example\.com/`},
+			want:    true,
+		},
+		{
+			name:    "test last @ is used",
+			email:   "test@example.com@evil.com",
+			domains: CommaSeparatedList{"example.com"},
+			want:    false,
+		},
+		{
+			name:    "test no domain",
+			email:   "test",
+			domains: CommaSeparatedList{"example.com"},
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidateDomains(tt.email, tt.domains); got != tt.want {
+				t.Errorf("ValidateDomains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validatePatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		wantErrs int
+	}{
+		{
+			name:     "test valid patterns",
+			patterns: []string{"test@example.com", "*.example.com", ".example.com", `/ops-\d+@example\.com/`},
+		},
+		{
+			name:     "test invalid regex",
+			patterns: []string{"/(/", "/[/", "example.com"},
+			wantErrs: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validatePatterns(tt.patterns); len(got) != tt.wantErrs {
+				t.Errorf("validatePatterns() = %v, want %d errors", got, tt.wantErrs)
+			}
+		})
+	}
+}
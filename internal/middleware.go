@@ -0,0 +1,122 @@
+package tfa
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/rajasoun/traefik-forward-auth/internal/provider"
+)
+
+type contextKey int
+
+const userContextKey contextKey = iota
+
+// UserFromContext returns the user authenticated by the middleware, if any
+func UserFromContext(ctx context.Context) (provider.User, bool) {
+	user, ok := ctx.Value(userContextKey).(provider.User)
+	return user, ok
+}
+
+// Middleware authenticates requests in-process, as traefik would with a
+// forward auth server. Allowed requests are passed to next, with the auth
+// response's headers and the user in the request context when authenticated,
+// all others are answered with the same redirects and pages the forward auth
+// server would return
+func (s *Server) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Use the same config throughout, even if reloaded meanwhile
+		s := s.active()
+
+		fr := forwardedRequest(r)
+		cw := &captureWriter{w: w, header: make(http.Header)}
+		s.RootHandler(cw, fr)
+		if !cw.allowed {
+			return
+		}
+
+		// Pass the auth response's headers on, as traefik's
+		// authResponseHeaders would, so the user can't be set by the client,
+		// and its cookies back to the client
+		r = r.Clone(r.Context())
+		r.Header.Del("X-Forwarded-User")
+		for k, v := range cw.header {
+			if k == "Set-Cookie" {
+				w.Header()[k] = append(w.Header()[k], v...)
+				continue
+			}
+			r.Header[k] = v
+		}
+
+		// Allow rules pass requests without a user
+		if email := cw.header.Get("X-Forwarded-User"); email != "" {
+			user := s.sessionUser(fr, email)
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedRequest copies r with the headers traefik would set when
+// forwarding it to the auth server
+func forwardedRequest(r *http.Request) *http.Request {
+	fr := r.Clone(r.Context())
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if fr.Header.Get("X-Forwarded-Proto") == "" {
+		fr.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := fr.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		fr.Header.Set("X-Forwarded-For", ip)
+	}
+	fr.Header.Set("X-Forwarded-Method", r.Method)
+	fr.Header.Set("X-Forwarded-Host", r.Host)
+	fr.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+
+	return fr
+}
+
+// captureWriter holds back a 200 response, which means the request is
+// allowed, and passes any other response through to the client
+type captureWriter struct {
+	w       http.ResponseWriter
+	header  http.Header
+	allowed bool
+	written bool
+}
+
+func (cw *captureWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	if cw.written {
+		return
+	}
+	cw.written = true
+
+	if code == http.StatusOK {
+		cw.allowed = true
+		return
+	}
+
+	for k, v := range cw.header {
+		cw.w.Header()[k] = v
+	}
+	cw.w.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	cw.WriteHeader(http.StatusOK)
+	if cw.allowed {
+		return len(b), nil
+	}
+	return cw.w.Write(b)
+}
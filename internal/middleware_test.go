@@ -0,0 +1,147 @@
+package tfa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rajasoun/traefik-forward-auth/internal/provider"
+	"golang.org/x/oauth2"
+)
+
+func setupMiddlewareTest(t *testing.T) (*Server, *Config) {
+	config := &Config{
+		Path:            "/_oauth",
+		Secret:          []byte("secret"),
+		Lifetime:        time.Hour,
+		CookieName:      "_forward_auth",
+		CSRFCookieName:  "_forward_auth_csrf",
+		UserInfoCookie:  "_user_info",
+		CookieHashKey:   "AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+		CookieBlockKey:  "R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+		DefaultAction:   "auth",
+		DefaultProvider: "oidc",
+		Rules: map[string]*Rule{
+			"public": {
+				Action: "allow",
+				Rule:   "PathPrefix(`/public`)",
+			},
+		},
+		Providers: provider.Providers{
+			OIDC: provider.OIDC{
+				OAuthProvider: provider.OAuthProvider{
+					Config: &oauth2.Config{},
+				},
+			},
+		},
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, config
+}
+
+func TestServer_Middleware(t *testing.T) {
+	s, config := setupMiddlewareTest(t)
+	auth := NewAuth(config)
+	r := newForwardedRequest("GET", "example.com", "/")
+	userCookie, err := auth.MakeUserCookie(r, "test@example.com|Test|User")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		uri               string
+		header            string
+		cookies           []*http.Cookie
+		wantCode          int
+		wantNext          bool
+		wantUser          *provider.User
+		wantForwardedUser string
+	}{
+		{
+			name:     "test unauthenticated",
+			uri:      "/private",
+			wantCode: http.StatusTemporaryRedirect,
+		},
+		{
+			name:     "test allow rule",
+			uri:      "/public",
+			wantCode: http.StatusOK,
+			wantNext: true,
+		},
+		{
+			name:     "test allow rule ignores client user header",
+			uri:      "/public",
+			header:   "mallory@example.com",
+			wantCode: http.StatusOK,
+			wantNext: true,
+		},
+		{
+			name:              "test auth cookie",
+			uri:               "/private",
+			header:            "mallory@example.com",
+			cookies:           []*http.Cookie{auth.MakeCookie(r, "test@example.com")},
+			wantCode:          http.StatusOK,
+			wantNext:          true,
+			wantUser:          &provider.User{Email: "test@example.com"},
+			wantForwardedUser: "test@example.com",
+		},
+		{
+			name:              "test auth and user info cookies",
+			uri:               "/private",
+			cookies:           []*http.Cookie{auth.MakeCookie(r, "test@example.com"), userCookie},
+			wantCode:          http.StatusOK,
+			wantNext:          true,
+			wantUser:          &provider.User{Email: "test@example.com", FirstName: "Test", LastName: "User"},
+			wantForwardedUser: "test@example.com",
+		},
+		{
+			name:     "test logout",
+			uri:      "/_oauth/logout",
+			cookies:  []*http.Cookie{auth.MakeCookie(r, "test@example.com")},
+			wantCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			var user *provider.User
+			var forwardedUser string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				forwardedUser = r.Header.Get("X-Forwarded-User")
+				if u, ok := UserFromContext(r.Context()); ok {
+					user = &u
+				}
+			})
+
+			req := httptest.NewRequest("GET", "http://example.com"+tt.uri, nil)
+			for _, c := range tt.cookies {
+				req.AddCookie(c)
+			}
+			if tt.header != "" {
+				req.Header.Set("X-Forwarded-User", tt.header)
+			}
+			w := httptest.NewRecorder()
+			s.Middleware(next).ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Middleware() code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if called != tt.wantNext {
+				t.Errorf("Middleware() called next = %v, want %v", called, tt.wantNext)
+			}
+			if (user == nil) != (tt.wantUser == nil) || (user != nil && !reflect.DeepEqual(*user, *tt.wantUser)) {
+				t.Errorf("Middleware() user = %v, want %v", user, tt.wantUser)
+			}
+			if forwardedUser != tt.wantForwardedUser {
+				t.Errorf("Middleware() X-Forwarded-User = %q, want %q", forwardedUser, tt.wantForwardedUser)
+			}
+		})
+	}
+}
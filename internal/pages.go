@@ -0,0 +1,179 @@
+package tfa
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Page names, templates in a template directory are named "<name>.html"
+const (
+	pageLayout    = "layout"
+	pageLogin     = "login"
+	pageChoose    = "choose"
+	pageLogout    = "logout"
+	pageForbidden = "forbidden"
+	pageError     = "error"
+)
+
+var pageNames = []string{pageLayout, pageLogin, pageChoose, pageLogout, pageForbidden, pageError}
+
+var defaultPages = map[string]string{
+	pageLayout: `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{ .Heading }} - {{ .Branding.Title }}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; background: #f6f8fa; color: #24292e; margin: 0; }
+main { max-width: 28em; margin: 15vh auto; padding: 2em; background: #fff; border-radius: 6px; box-shadow: 0 1px 3px rgba(0,0,0,.15); text-align: center; }
+img { max-height: 4em; margin-bottom: 1em; }
+a.button { display: inline-block; padding: .6em 1.4em; border-radius: 4px; color: #fff; text-decoration: none; background: {{ .Branding.Color }}; }
+.reason { color: #586069; }
+.request-id { color: #959da5; font-size: .8em; margin-top: 2em; }
+</style>
+</head>
+<body>
+<main>
+{{ if .Branding.LogoURL }}<img src="{{ .Branding.LogoURL }}" alt="{{ .Branding.Title }}">{{ end }}
+<h1>{{ .Heading }}</h1>
+{{ template "content" . }}
+{{ if .RequestID }}<p class="request-id">Request ID: {{ .RequestID }}</p>{{ end }}
+</main>
+</body>
+</html>`,
+	pageLogin: `{{ define "content" }}<p>You need to sign in to continue.</p>
+<p><a class="button" href="{{ .LoginURL }}">Sign in</a></p>{{ end }}`,
+	pageChoose: `{{ define "content" }}<p>Choose how you would like to sign in.</p>
+{{ range .Providers }}<p><a class="button" href="{{ .URL }}">{{ .Name }}</a></p>
+{{ end }}{{ end }}`,
+	pageLogout: `{{ define "content" }}<p>You have been logged out.</p>{{ end }}`,
+	pageForbidden: `{{ define "content" }}<p>You are not allowed to access this page.</p>
+{{ if .Reason }}<p class="reason">{{ .Reason }}</p>{{ end }}{{ end }}`,
+	pageError: `{{ define "content" }}<p>Something went wrong while signing you in.</p>
+{{ if .Reason }}<p class="reason">{{ .Reason }}</p>{{ end }}{{ end }}`,
+}
+
+var pageHeadings = map[string]string{
+	pageLogin:     "Sign in",
+	pageChoose:    "Sign in",
+	pageLogout:    "Signed out",
+	pageForbidden: "Forbidden",
+	pageError:     "Error",
+}
+
+// Branding holds the values used to customise the rendered pages
+type Branding struct {
+	Title   string `long:"title" env:"TITLE" default:"Traefik Forward Auth" description:"Title shown on pages"`
+	LogoURL string `long:"logo-url" env:"LOGO_URL" description:"URL of a logo shown on pages"`
+	Color   string `long:"color" env:"COLOR" default:"#0366d6" description:"Accent color used on pages"`
+}
+
+// Pages holds the parsed page templates
+type Pages struct {
+	templates map[string]*template.Template
+	branding  Branding
+}
+
+// PageData is passed to the page templates
+type PageData struct {
+	Branding  Branding
+	Heading   string
+	Reason    string
+	LoginURL  string
+	Providers []ProviderChoice
+	RequestID string
+}
+
+// ProviderChoice is a provider listed on the chooser page
+type ProviderChoice struct {
+	Name string
+	URL  string
+}
+
+// NewPages parses the built in page templates, replacing any that have an
+// override of the same name in dir
+func NewPages(dir string, branding Branding) (*Pages, error) {
+	sources := make(map[string]string, len(defaultPages))
+	for name, source := range defaultPages {
+		sources[name] = source
+	}
+
+	if dir != "" {
+		for _, name := range pageNames {
+			b, err := ioutil.ReadFile(filepath.Join(dir, name+".html"))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			sources[name] = string(b)
+		}
+	}
+
+	layout, err := template.New(pageLayout).Parse(sources[pageLayout])
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %w", pageLayout, err)
+	}
+
+	p := &Pages{
+		templates: make(map[string]*template.Template),
+		branding:  branding,
+	}
+	for _, name := range pageNames[1:] {
+		t, err := template.Must(layout.Clone()).Parse(sources[name])
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", name, err)
+		}
+		p.templates[name] = t
+	}
+
+	return p, nil
+}
+
+// Render writes the named page with the given status code. Requests made by
+// scripts receive the same information as JSON. If the page template fails a
+// plain error is written and the template error returned
+func (p *Pages) Render(w http.ResponseWriter, r *http.Request, status int, name string, data PageData) error {
+	data.Branding = p.branding
+	data.Heading = pageHeadings[name]
+	data.RequestID = r.Header.Get("X-Request-Id")
+
+	if isAPIRequest(r, "auto") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Error     string `json:"error"`
+			Reason    string `json:"reason,omitempty"`
+			RequestID string `json:"request_id,omitempty"`
+		}{name, data.Reason, data.RequestID})
+		return nil
+	}
+
+	// Render to a buffer first so a template error doesn't produce a
+	// partial page
+	var buf bytes.Buffer
+	if err := p.templates[name].ExecuteTemplate(&buf, pageLayout, data); err != nil {
+		http.Error(w, http.StatusText(status), status)
+		return fmt.Errorf("rendering %s page: %w", name, err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+	return nil
+}
+
+// newRequestID generates an id for requests which didn't arrive with one
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
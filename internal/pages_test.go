@@ -0,0 +1,131 @@
+package tfa
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfa-pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "forbidden.html"), []byte(`{{ define "content" }}custom {{ .Reason }}{{ end }}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "broken"), 0755)
+	err = ioutil.WriteFile(filepath.Join(dir, "broken", "error.html"), []byte(`{{ define "content" }}{{ end`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		page    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "test default pages",
+			dir:  "",
+			page: pageForbidden,
+			want: "You are not allowed to access this page.",
+		},
+		{
+			name: "test override",
+			dir:  dir,
+			page: pageForbidden,
+			want: "custom some reason",
+		},
+		{
+			name: "test missing override uses default",
+			dir:  dir,
+			page: pageLogout,
+			want: "You have been logged out.",
+		},
+		{
+			name:    "test invalid template",
+			dir:     filepath.Join(dir, "broken"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewPages(tt.dir, Branding{Title: "Brand"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewPages() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "http://example.com", nil)
+			got.Render(w, r, 403, tt.page, PageData{Reason: "some reason"})
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("Pages.Render() = %v, want %v", w.Body.String(), tt.want)
+			}
+			if !strings.Contains(w.Body.String(), "Brand") {
+				t.Errorf("Pages.Render() = %v, want branding", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPages_Render(t *testing.T) {
+	p, err := NewPages("", Branding{Title: "Brand"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		accept   string
+		wantType string
+		want     string
+	}{
+		{
+			name:     "test html",
+			accept:   "text/html",
+			wantType: "text/html; charset=utf-8",
+			want:     "Request ID: abc123",
+		},
+		{
+			name:     "test json",
+			accept:   "application/json",
+			wantType: "application/json",
+			want:     `"request_id":"abc123"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "http://example.com", nil)
+			r.Header.Set("Accept", tt.accept)
+			r.Header.Set("X-Request-Id", "abc123")
+			p.Render(w, r, 500, pageError, PageData{Reason: "<script>"})
+
+			if w.Code != 500 {
+				t.Errorf("Pages.Render() code = %v, want 500", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.wantType {
+				t.Errorf("Pages.Render() content type = %v, want %v", ct, tt.wantType)
+			}
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("Pages.Render() = %v, want %v", w.Body.String(), tt.want)
+			}
+			if strings.Contains(w.Body.String(), "<script>") {
+				t.Errorf("Pages.Render() = %v, reason should be escaped", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package tfa
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rajasoun/traefik-forward-auth/internal/provider"
+)
+
+// Rule policies are boolean expressions in Go syntax, such as:
+//
+//   contains(user.groups, "ops") || (user.domain == "finance.example.com" && request.method == "GET")
+//
+// They're compiled and type checked once, then evaluated against the user
+// and forwarded request of each authenticated request the rule matches
+
+// policyInput is what a policy is evaluated against
+type policyInput struct {
+	user provider.User
+	r    *http.Request
+	now  time.Time
+}
+
+// policyType is the type of a policy expression
+type policyType int
+
+const (
+	policyBool policyType = iota
+	policyString
+	policyInt
+	policyList
+	policyHeaders
+)
+
+func (t policyType) String() string {
+	switch t {
+	case policyBool:
+		return "bool"
+	case policyString:
+		return "string"
+	case policyInt:
+		return "int"
+	case policyList:
+		return "list"
+	}
+	return "headers"
+}
+
+// policyExpr is a compiled and type checked policy expression, constant
+// expressions don't depend on the input so can be evaluated with nil
+type policyExpr struct {
+	typ      policyType
+	eval     func(in *policyInput) interface{}
+	constant bool
+}
+
+func policyConst(typ policyType, v interface{}) policyExpr {
+	return policyExpr{typ: typ, eval: func(*policyInput) interface{} { return v }, constant: true}
+}
+
+// policyVars are the identifiers available to policies
+var policyVars = map[string]policyExpr{
+	"user.email": {typ: policyString, eval: func(in *policyInput) interface{} {
+		return in.user.Email
+	}},
+	"user.domain": {typ: policyString, eval: func(in *policyInput) interface{} {
+		return in.user.Email[strings.LastIndex(in.user.Email, "@")+1:]
+	}},
+	"user.groups": {typ: policyList, eval: func(in *policyInput) interface{} {
+		return in.user.Groups
+	}},
+	"request.method": {typ: policyString, eval: func(in *policyInput) interface{} {
+		return in.r.Method
+	}},
+	"request.host": {typ: policyString, eval: func(in *policyInput) interface{} {
+		return in.r.Host
+	}},
+	"request.path": {typ: policyString, eval: func(in *policyInput) interface{} {
+		return in.r.URL.Path
+	}},
+	"request.headers": {typ: policyHeaders, eval: func(in *policyInput) interface{} {
+		return in.r.Header
+	}},
+	"time.hour": {typ: policyInt, eval: func(in *policyInput) interface{} {
+		return in.now.UTC().Hour()
+	}},
+	"time.weekday": {typ: policyString, eval: func(in *policyInput) interface{} {
+		return in.now.UTC().Weekday().String()
+	}},
+}
+
+// policyFuncs are the functions available to policies, each type checks its
+// compiled arguments and returns the compiled call
+var policyFuncs = map[string]func(args []policyExpr) (policyExpr, error){
+	"contains": func(args []policyExpr) (policyExpr, error) {
+		if err := checkPolicyArgs("contains", args, -1, policyString); err != nil {
+			return policyExpr{}, err
+		}
+		list, value := args[0].eval, args[1].eval
+		switch args[0].typ {
+		case policyList:
+			return policyExpr{typ: policyBool, eval: func(in *policyInput) interface{} {
+				v := value(in).(string)
+				for _, item := range list(in).([]string) {
+					if item == v {
+						return true
+					}
+				}
+				return false
+			}}, nil
+		case policyString:
+			return policyExpr{typ: policyBool, eval: func(in *policyInput) interface{} {
+				return strings.Contains(list(in).(string), value(in).(string))
+			}}, nil
+		}
+		return policyExpr{}, fmt.Errorf("contains expects a list or string, got %s", args[0].typ)
+	},
+	"hasPrefix": stringsPolicyFunc("hasPrefix", strings.HasPrefix),
+	"hasSuffix": stringsPolicyFunc("hasSuffix", strings.HasSuffix),
+	"lower": func(args []policyExpr) (policyExpr, error) {
+		if err := checkPolicyArgs("lower", args, policyString); err != nil {
+			return policyExpr{}, err
+		}
+		s := args[0].eval
+		return policyExpr{typ: policyString, eval: func(in *policyInput) interface{} {
+			return strings.ToLower(s(in).(string))
+		}}, nil
+	},
+	"matches": func(args []policyExpr) (policyExpr, error) {
+		if err := checkPolicyArgs("matches", args, policyString, policyString); err != nil {
+			return policyExpr{}, err
+		}
+		if !args[1].constant {
+			return policyExpr{}, errors.New("matches expects a string literal pattern")
+		}
+		re, err := regexp.Compile(args[1].eval(nil).(string))
+		if err != nil {
+			return policyExpr{}, fmt.Errorf("matches: %w", err)
+		}
+		s := args[0].eval
+		return policyExpr{typ: policyBool, eval: func(in *policyInput) interface{} {
+			return re.MatchString(s(in).(string))
+		}}, nil
+	},
+}
+
+// stringsPolicyFunc adapts a func(s, substr string) bool to a policy function
+func stringsPolicyFunc(name string, fn func(s, substr string) bool) func(args []policyExpr) (policyExpr, error) {
+	return func(args []policyExpr) (policyExpr, error) {
+		if err := checkPolicyArgs(name, args, policyString, policyString); err != nil {
+			return policyExpr{}, err
+		}
+		s, substr := args[0].eval, args[1].eval
+		return policyExpr{typ: policyBool, eval: func(in *policyInput) interface{} {
+			return fn(s(in).(string), substr(in).(string))
+		}}, nil
+	}
+}
+
+// checkPolicyArgs checks the number and types of a function's arguments,
+// where a type of -1 accepts any type
+func checkPolicyArgs(name string, args []policyExpr, types ...policyType) error {
+	if len(args) != len(types) {
+		return fmt.Errorf("%s expects %d arguments, got %d", name, len(types), len(args))
+	}
+	for i, typ := range types {
+		if typ >= 0 && args[i].typ != typ {
+			return fmt.Errorf("%s expects a %s as argument %d, got %s", name, typ, i+1, args[i].typ)
+		}
+	}
+	return nil
+}
+
+// policy is a compiled policy, true if the request is permitted
+type policy func(in *policyInput) bool
+
+type compiledPolicy struct {
+	p   policy
+	err error
+}
+
+var policyCache sync.Map
+
+// compilePolicy compiles and type checks a policy, caching the result
+func compilePolicy(src string) (policy, error) {
+	if cached, ok := policyCache.Load(src); ok {
+		c := cached.(compiledPolicy)
+		return c.p, c.err
+	}
+
+	var c compiledPolicy
+	node, err := parser.ParseExpr(src)
+	if err != nil {
+		c.err = fmt.Errorf("invalid policy: %w", err)
+	} else if e, err := compilePolicyExpr(node); err != nil {
+		c.err = fmt.Errorf("invalid policy: %w", err)
+	} else if e.typ != policyBool {
+		c.err = fmt.Errorf("invalid policy: must be a bool expression, got %s", e.typ)
+	} else {
+		c.p = func(in *policyInput) bool { return e.eval(in).(bool) }
+	}
+
+	policyCache.Store(src, c)
+	return c.p, c.err
+}
+
+func compilePolicyExpr(node ast.Expr) (policyExpr, error) {
+	switch n := node.(type) {
+	case *ast.ParenExpr:
+		return compilePolicyExpr(n.X)
+
+	case *ast.BasicLit:
+		switch n.Kind {
+		case token.STRING:
+			s, err := strconv.Unquote(n.Value)
+			if err != nil {
+				return policyExpr{}, err
+			}
+			return policyConst(policyString, s), nil
+		case token.INT:
+			i, err := strconv.Atoi(n.Value)
+			if err != nil {
+				return policyExpr{}, err
+			}
+			return policyConst(policyInt, i), nil
+		}
+		return policyExpr{}, fmt.Errorf("unsupported literal %s", n.Value)
+
+	case *ast.Ident:
+		switch n.Name {
+		case "true":
+			return policyConst(policyBool, true), nil
+		case "false":
+			return policyConst(policyBool, false), nil
+		}
+		return policyExpr{}, fmt.Errorf("unknown identifier %s", n.Name)
+
+	case *ast.SelectorExpr:
+		if x, ok := n.X.(*ast.Ident); ok {
+			if v, ok := policyVars[x.Name+"."+n.Sel.Name]; ok {
+				return v, nil
+			}
+			return policyExpr{}, fmt.Errorf("unknown identifier %s.%s", x.Name, n.Sel.Name)
+		}
+		return policyExpr{}, errors.New("unsupported selector")
+
+	case *ast.IndexExpr:
+		x, err := compilePolicyExpr(n.X)
+		if err != nil {
+			return policyExpr{}, err
+		}
+		key, err := compilePolicyExpr(n.Index)
+		if err != nil {
+			return policyExpr{}, err
+		}
+		if x.typ != policyHeaders || key.typ != policyString {
+			return policyExpr{}, fmt.Errorf("cannot index %s with %s", x.typ, key.typ)
+		}
+		return policyExpr{typ: policyString, eval: func(in *policyInput) interface{} {
+			return x.eval(in).(http.Header).Get(key.eval(in).(string))
+		}}, nil
+
+	case *ast.CallExpr:
+		name, ok := n.Fun.(*ast.Ident)
+		if !ok {
+			return policyExpr{}, errors.New("unsupported function call")
+		}
+		fn, ok := policyFuncs[name.Name]
+		if !ok {
+			return policyExpr{}, fmt.Errorf("unknown function %s", name.Name)
+		}
+		args := make([]policyExpr, len(n.Args))
+		for i, arg := range n.Args {
+			var err error
+			if args[i], err = compilePolicyExpr(arg); err != nil {
+				return policyExpr{}, err
+			}
+		}
+		return fn(args)
+
+	case *ast.UnaryExpr:
+		x, err := compilePolicyExpr(n.X)
+		if err != nil {
+			return policyExpr{}, err
+		}
+		if n.Op != token.NOT || x.typ != policyBool {
+			return policyExpr{}, fmt.Errorf("invalid operation %s%s", n.Op, x.typ)
+		}
+		return policyExpr{typ: policyBool, eval: func(in *policyInput) interface{} {
+			return !x.eval(in).(bool)
+		}}, nil
+
+	case *ast.BinaryExpr:
+		x, err := compilePolicyExpr(n.X)
+		if err != nil {
+			return policyExpr{}, err
+		}
+		y, err := compilePolicyExpr(n.Y)
+		if err != nil {
+			return policyExpr{}, err
+		}
+		return compilePolicyBinary(n.Op, x, y)
+	}
+
+	return policyExpr{}, fmt.Errorf("unsupported expression %T", node)
+}
+
+func compilePolicyBinary(op token.Token, x, y policyExpr) (policyExpr, error) {
+	invalid := fmt.Errorf("invalid operation %s %s %s", x.typ, op, y.typ)
+	if x.typ != y.typ {
+		return policyExpr{}, invalid
+	}
+
+	switch op {
+	case token.LAND, token.LOR:
+		if x.typ != policyBool {
+			return policyExpr{}, invalid
+		}
+		if op == token.LAND {
+			return policyExpr{typ: policyBool, eval: func(in *policyInput) interface{} {
+				return x.eval(in).(bool) && y.eval(in).(bool)
+			}}, nil
+		}
+		return policyExpr{typ: policyBool, eval: func(in *policyInput) interface{} {
+			return x.eval(in).(bool) || y.eval(in).(bool)
+		}}, nil
+
+	case token.EQL, token.NEQ:
+		if x.typ == policyList || x.typ == policyHeaders {
+			return policyExpr{}, invalid
+		}
+		want := op == token.EQL
+		return policyExpr{typ: policyBool, eval: func(in *policyInput) interface{} {
+			return (x.eval(in) == y.eval(in)) == want
+		}}, nil
+
+	case token.LSS, token.LEQ, token.GTR, token.GEQ:
+		if x.typ != policyInt {
+			return policyExpr{}, invalid
+		}
+		return policyExpr{typ: policyBool, eval: func(in *policyInput) interface{} {
+			a, b := x.eval(in).(int), y.eval(in).(int)
+			switch op {
+			case token.LSS:
+				return a < b
+			case token.LEQ:
+				return a <= b
+			case token.GTR:
+				return a > b
+			}
+			return a >= b
+		}}, nil
+	}
+
+	return policyExpr{}, invalid
+}
+
+// policyAllows evaluates the rule's policy, if it has one, for the user
+// authenticated as email
+func (s *Server) policyAllows(rule string, r *http.Request, email string) bool {
+	rl, ok := s.config.Rules[rule]
+	if !ok || rl.Policy == "" {
+		return true
+	}
+
+	p, err := compilePolicy(rl.Policy)
+	if err != nil {
+		return false
+	}
+
+	return p(&policyInput{user: s.sessionUser(r, email), r: r, now: time.Now()})
+}
@@ -0,0 +1,253 @@
+package tfa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rajasoun/traefik-forward-auth/internal/provider"
+	"golang.org/x/oauth2"
+)
+
+func Test_compilePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{
+			name:   "test groups and request",
+			policy: `contains(user.groups, "ops") || (user.domain == "finance.example.com" && request.method == "GET")`,
+		},
+		{
+			name:   "test headers and time",
+			policy: `request.headers["X-Team"] != "" && time.hour >= 9 && time.hour < 18 && time.weekday != "Sunday"`,
+		},
+		{
+			name:   "test functions",
+			policy: `hasPrefix(request.path, "/api") && !hasSuffix(lower(user.email), "@contractor.com") && matches(request.host, "^[a-z]+\\.example\\.com$")`,
+		},
+		{
+			name:    "test syntax error",
+			policy:  `user.email ==`,
+			wantErr: true,
+		},
+		{
+			name:    "test not bool",
+			policy:  `user.email`,
+			wantErr: true,
+		},
+		{
+			name:    "test unknown identifier",
+			policy:  `user.role == "admin"`,
+			wantErr: true,
+		},
+		{
+			name:    "test unknown function",
+			policy:  `startsWith(request.path, "/api")`,
+			wantErr: true,
+		},
+		{
+			name:    "test mismatched types",
+			policy:  `time.hour == "9"`,
+			wantErr: true,
+		},
+		{
+			name:    "test ordering strings",
+			policy:  `user.email < "m"`,
+			wantErr: true,
+		},
+		{
+			name:    "test wrong argument type",
+			policy:  `contains(user.groups, 1)`,
+			wantErr: true,
+		},
+		{
+			name:    "test pattern not a literal",
+			policy:  `matches(request.path, user.email)`,
+			wantErr: true,
+		},
+		{
+			name:    "test invalid pattern",
+			policy:  `matches(request.path, "(")`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := compilePolicy(tt.policy); (err != nil) != tt.wantErr {
+				t.Errorf("compilePolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_policy(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://app.example.com/api/users", nil)
+	r.Header.Set("X-Team", "payments")
+	in := &policyInput{
+		user: provider.User{Email: "alice@finance.example.com", Groups: []string{"dev", "ops"}},
+		r:    r,
+		now:  time.Date(2020, 1, 4, 10, 30, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name   string
+		policy string
+		want   bool
+	}{
+		{
+			name:   "test group",
+			policy: `contains(user.groups, "ops")`,
+			want:   true,
+		},
+		{
+			name:   "test missing group",
+			policy: `contains(user.groups, "admin")`,
+			want:   false,
+		},
+		{
+			name:   "test domain and method",
+			policy: `contains(user.groups, "admin") || (user.domain == "finance.example.com" && request.method == "GET")`,
+			want:   true,
+		},
+		{
+			name:   "test host and path",
+			policy: `request.host == "app.example.com" && hasPrefix(request.path, "/api/")`,
+			want:   true,
+		},
+		{
+			name:   "test header",
+			policy: `request.headers["x-team"] == "payments"`,
+			want:   true,
+		},
+		{
+			name:   "test time",
+			policy: `time.hour >= 9 && time.hour < 18 && time.weekday != "Saturday"`,
+			want:   false,
+		},
+		{
+			name:   "test matches",
+			policy: `matches(user.email, "^[a-z]+@finance\\.example\\.com$")`,
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := compilePolicy(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p(in); got != tt.want {
+				t.Errorf("policy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_rulePolicy(t *testing.T) {
+	config := &Config{
+		Path:            "/_oauth",
+		Secret:          []byte("secret"),
+		Lifetime:        time.Hour,
+		CookieName:      "_forward_auth",
+		CSRFCookieName:  "_forward_auth_csrf",
+		UserInfoCookie:  "_user_info",
+		UserInfoFormat:  "json",
+		CookieHashKey:   "AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+		CookieBlockKey:  "R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+		DefaultAction:   "auth",
+		DefaultProvider: "oidc",
+		Rules: map[string]*Rule{
+			"admin": {
+				Action:   "auth",
+				Rule:     "PathPrefix(`/admin`)",
+				Provider: "oidc",
+				Policy:   `contains(user.groups, "ops") || (user.domain == "finance.example.com" && request.method == "GET")`,
+			},
+		},
+		Providers: provider.Providers{
+			OIDC: provider.OIDC{
+				OAuthProvider: provider.OAuthProvider{
+					Config: &oauth2.Config{},
+				},
+			},
+		},
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewAuth(config)
+
+	userCookie := func(user provider.User) *http.Cookie {
+		c, err := auth.MakeUserInfoCookie(newForwardedRequest("GET", "example.com", "/"), user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		uri      string
+		email    string
+		user     *provider.User
+		wantCode int
+	}{
+		{
+			name:     "test group permitted",
+			method:   "POST",
+			uri:      "/admin",
+			email:    "bob@example.com",
+			user:     &provider.User{Email: "bob@example.com", Groups: []string{"ops"}},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "test group from another user ignored",
+			method:   "POST",
+			uri:      "/admin",
+			email:    "eve@example.com",
+			user:     &provider.User{Email: "bob@example.com", Groups: []string{"ops"}},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "test domain and method permitted",
+			method:   "GET",
+			uri:      "/admin",
+			email:    "alice@finance.example.com",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "test domain and method forbidden",
+			method:   "POST",
+			uri:      "/admin",
+			email:    "alice@finance.example.com",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "test other rules unaffected",
+			method:   "POST",
+			uri:      "/other",
+			email:    "eve@example.com",
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newForwardedRequest(tt.method, "example.com", tt.uri)
+			r.AddCookie(auth.MakeCookie(r, tt.email))
+			if tt.user != nil {
+				r.AddCookie(userCookie(*tt.user))
+			}
+
+			w := httptest.NewRecorder()
+			s.RootHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("RootHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -16,7 +16,7 @@ import (
 type OIDC struct {
 	IssuerURL    string `long:"issuer-url" env:"ISSUER_URL" description:"Issuer URL"`
 	ClientID     string `long:"client-id" env:"CLIENT_ID" description:"Client ID"`
-	ClientSecret string `long:"client-secret" env:"CLIENT_SECRET" description:"Client Secret" json:"-"`
+	ClientSecret string `long:"client-secret" env:"CLIENT_SECRET" description:"Client Secret" json:"-" secret:"true"`
 
 	OAuthProvider
 
@@ -24,18 +24,42 @@ type OIDC struct {
 	verifier               *oidc.IDTokenVerifier
 	APIResourceURI         string `long:"resource-uri" env:"API_RESOURCE_URI" description:"API resource uri"`
 	APIAccessTokenEndpoint string `long:"token-endpoint" env:"API_ACCESS_TOKEN_ENDPOINT" description:"API access token endpoint"`
+
+	// name is set on additional, named, OIDC providers
+	name string
+}
+
+// NewNamedOIDC creates an additional OIDC provider with the given name
+func NewNamedOIDC(name string) *OIDC {
+	return &OIDC{name: name}
 }
 
 // Name returns the name of the provider
 func (o *OIDC) Name() string {
+	if o.name != "" {
+		return o.name
+	}
 	return "oidc"
 }
 
+// Validate checks the required options are set
+func (o *OIDC) Validate() error {
+	if o.IssuerURL == "" || o.ClientID == "" || o.ClientSecret == "" {
+		prefix := "providers.oidc."
+		if o.name != "" {
+			prefix = "provider." + o.name + "."
+		}
+		return fmt.Errorf("%[1]sissuer-url, %[1]sclient-id, %[1]sclient-secret must be set", prefix)
+	}
+
+	return nil
+}
+
 // Setup performs validation and setup
 func (o *OIDC) Setup() error {
 	// Check parms
-	if o.IssuerURL == "" || o.ClientID == "" || o.ClientSecret == "" {
-		return errors.New("providers.oidc.issuer-url, providers.oidc.client-id, providers.oidc.client-secret must be set")
+	if err := o.Validate(); err != nil {
+		return err
 	}
 
 	var err error
@@ -66,8 +90,8 @@ func (o *OIDC) Setup() error {
 }
 
 // GetLoginURL provides the login url for the given redirect uri and state
-func (o *OIDC) GetLoginURL(redirectURI, state string) string {
-	return o.OAuthGetLoginURL(redirectURI, state)
+func (o *OIDC) GetLoginURL(redirectURI, state string, opts ...oauth2.AuthCodeOption) string {
+	return o.OAuthGetLoginURL(redirectURI, state, opts...)
 }
 
 // ExchangeCode exchanges the given redirect uri and code for a token
@@ -89,39 +113,75 @@ func (o *OIDC) ExchangeCode(redirectURI, code string) (string, error) {
 // GetUserFromCode provides user information
 func (o *OIDC) GetUserFromCode(code, redirectURI string) (User, error) {
 
-	accessToken, err := getAccessToken(o.APIAccessTokenEndpoint, code, o.ClientID, o.ClientSecret, "authorization_code", redirectURI)
+	accessToken, idToken, err := getAccessToken(o.APIAccessTokenEndpoint, code, o.ClientID, o.ClientSecret, "authorization_code", redirectURI)
+	if err != nil {
+		return User{}, err
+	}
+
+	user, err := getUserInfo(o.APIResourceURI, accessToken)
 	if err != nil {
 		return User{}, err
 	}
 
-	return getUserInfo(o.APIResourceURI, accessToken)
+	// The userinfo endpoint doesn't describe the authentication, so take
+	// that from the id token when there is one
+	if idToken != "" && o.verifier != nil {
+		if err := o.idTokenClaims(idToken, &user); err != nil {
+			return User{}, err
+		}
+	}
+
+	return user, nil
+}
+
+// idTokenClaims verifies the id token and copies the claims describing how
+// the user authenticated to user, along with their groups if not yet known
+func (o *OIDC) idTokenClaims(rawIDToken string, user *User) error {
+	idToken, err := o.verifier.Verify(context.Background(), rawIDToken)
+	if err != nil {
+		return fmt.Errorf("id token verify: %w", err)
+	}
+
+	var claims User
+	if err := idToken.Claims(&claims); err != nil {
+		return fmt.Errorf("id token claims: %w", err)
+	}
+
+	user.ACR = claims.ACR
+	user.AMR = claims.AMR
+	user.AuthTime = claims.AuthTime
+	if len(user.Groups) == 0 {
+		user.Groups = claims.Groups
+	}
+	return nil
 }
 
-func getAccessToken(APIAccessTokenEndpoint, code, clientID, clientSecret, authorizationCode, redirectURI string) (string, error) {
+func getAccessToken(APIAccessTokenEndpoint, code, clientID, clientSecret, authorizationCode, redirectURI string) (string, string, error) {
 
 	url := fmt.Sprintf("%s?code=%s&client_id=%s&client_secret=%s&grant_type=%s&redirect_uri=%s",
 		APIAccessTokenEndpoint, code, clientID, clientSecret, authorizationCode, redirectURI)
 	resp, err := http.Post(url, "", nil)
 	if err != nil {
-		return "", fmt.Errorf("access token endpoint post: %w", err)
+		return "", "", fmt.Errorf("access token endpoint post: %w", err)
 	}
 	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("resource endpoint post response read all: \n%s\n error: %w", string(data), err)
+		return "", "", fmt.Errorf("resource endpoint post response read all: \n%s\n error: %w", string(data), err)
 	}
 
 	token := struct {
 		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
 	}{}
 	err = json.Unmarshal(data, &token)
 	if err != nil {
-		return "", fmt.Errorf("access token endpoint post json unmarshal: %w", err)
+		return "", "", fmt.Errorf("access token endpoint post json unmarshal: %w", err)
 	}
 	if token.AccessToken == "" {
-		return "", fmt.Errorf("access token empty: %s", string(data))
+		return "", "", fmt.Errorf("access token empty: %s", string(data))
 	}
-	return token.AccessToken, nil
+	return token.AccessToken, token.IDToken, nil
 }
 
 func getUserInfo(APIResourceURI, accessToken string) (User, error) {
@@ -145,7 +205,7 @@ func getUserInfo(APIResourceURI, accessToken string) (User, error) {
 
 	user := User{}
 	if err := json.Unmarshal(data, &user); err != nil {
-		return User{}, fmt.Errorf("resource endpoint get response unmarshal: \ntoken: %s\n%s\n error: %w", accessToken, string(data), err)
+		return User{}, fmt.Errorf("resource endpoint get response unmarshal: \n%s\n error: %w", string(data), err)
 	}
 	return user, nil
 }
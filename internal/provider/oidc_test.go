@@ -1,6 +1,8 @@
 package provider
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -64,6 +66,27 @@ func TestOIDC_GetUserFromCode(t *testing.T) {
 			want:    User{},
 			wantErr: true,
 		},
+		{
+			name: "test id token claims",
+			fields: fields{
+				APIAccessTokenEndpoint: "http://" + mockServer.Listener.Addr().String() + "/path3",
+				APIResourceURI:         "http://" + mockServer.Listener.Addr().String() + "/path2",
+				verifier:               oidc.NewVerifier("https://issuer.example.com", payloadKeySet{}, &oidc.Config{ClientID: "client"}),
+			},
+			args: args{
+				code:        "9WFt1LbLRt46ISEfUGiXqVL7JE25Ee2CegwAAAEx",
+				redirectURI: "https%3A%2F%2FredirectURI",
+			},
+			want: User{
+				ID:       "user_id",
+				Email:    "user@domain.com",
+				Groups:   []string{"ops"},
+				AuthTime: 1600000000,
+				ACR:      "urn:example:mfa",
+				AMR:      []string{"pwd", "otp"},
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -95,6 +118,9 @@ func setupSubTest(t *testing.T) func(t *testing.T) {
 		if strings.Contains(r.URL.Path, "/path1") {
 			w.Write([]byte(`{"access_token":"aodifuvboadifubv"}`))
 		}
+		if strings.Contains(r.URL.Path, "/path3") {
+			w.Write([]byte(`{"access_token":"aodifuvboadifubv","id_token":"` + testIDToken + `"}`))
+		}
 		if strings.Contains(r.URL.Path, "/path2") {
 			w.Write([]byte(`{"sub":"user_id","email":"user@domain.com"}`))
 		}
@@ -104,6 +130,22 @@ func setupSubTest(t *testing.T) func(t *testing.T) {
 	return func(t *testing.T) {}
 }
 
+// testIDToken is an unsigned id token with the claims describing how the
+// user authenticated, accepted by payloadKeySet
+var testIDToken = strings.Join([]string{
+	base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`)),
+	base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"https://issuer.example.com","aud":"client","sub":"user_id","exp":4102444800,` +
+		`"auth_time":1600000000,"acr":"urn:example:mfa","amr":["pwd","otp"],"groups":["ops"]}`)),
+	base64.RawURLEncoding.EncodeToString([]byte("signature")),
+}, ".")
+
+// payloadKeySet accepts any signature, returning the token's payload
+type payloadKeySet struct{}
+
+func (payloadKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.Split(jwt, ".")[1])
+}
+
 func teardownSubTest(t *testing.T) func(t *testing.T) {
 	defer mockServer.Close()
 	return func(t *testing.T) {}
@@ -207,6 +249,10 @@ func TestOIDC_Name(t *testing.T) {
 			}
 		})
 	}
+
+	if got := NewNamedOIDC("corp").Name(); got != "corp" {
+		t.Errorf("OIDC.Name() = %v, want corp", got)
+	}
 }
 
 func TestOIDC_GetLoginURL(t *testing.T) {
@@ -15,32 +15,46 @@ type Providers struct {
 // Provider is used to authenticate users
 type Provider interface {
 	Name() string
-	GetLoginURL(redirectURI, state string) string
+	GetLoginURL(redirectURI, state string, opts ...oauth2.AuthCodeOption) string
 	ExchangeCode(redirectURI, code string) (string, error)
 	GetUser(token string) (User, error)
 	GetUserFromCode(code, redirectURI string) (User, error)
 	Setup() error
 }
 
+// Validator is implemented by providers which can check their options
+// without contacting the provider
+type Validator interface {
+	Validate() error
+}
+
 type token struct {
 	Token string `json:"access_token"`
 }
 
 // User is the authenticated user
 type User struct {
-	ID        string `json:"sub"`
-	Email     string `json:"email"`
-	Verified  bool   `json:"verified_email"`
-	Hd        string `json:"hd"`
-	FirstName string `json:"given_name"`
-	LastName  string `json:"family_name"`
+	ID        string   `json:"sub,omitempty"`
+	Email     string   `json:"email"`
+	Verified  bool     `json:"verified_email,omitempty"`
+	Hd        string   `json:"hd,omitempty"`
+	FirstName string   `json:"given_name,omitempty"`
+	LastName  string   `json:"family_name,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+
+	// AuthTime is when the user last authenticated with the provider, as
+	// seconds since the epoch, ACR and AMR are the context class and methods
+	// of that authentication
+	AuthTime int64    `json:"auth_time,omitempty"`
+	ACR      string   `json:"acr,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
 }
 
 // OAuthProvider is a provider using the oauth2 library
 type OAuthProvider struct {
 	Resource string `long:"resource" env:"RESOURCE" description:"Optional resource indicator"`
 
-	Config *oauth2.Config
+	Config *oauth2.Config `json:"-"`
 	ctx    context.Context
 }
 
@@ -52,15 +66,16 @@ func (p *OAuthProvider) ConfigCopy(redirectURI string) oauth2.Config {
 	return config
 }
 
-// OAuthGetLoginURL provides a base "GetLoginURL" for proiders using OAauth2
-func (p *OAuthProvider) OAuthGetLoginURL(redirectURI, state string) string {
+// OAuthGetLoginURL provides a base "GetLoginURL" for proiders using OAauth2,
+// opts add parameters such as "prompt" or "max_age" to the login url
+func (p *OAuthProvider) OAuthGetLoginURL(redirectURI, state string, opts ...oauth2.AuthCodeOption) string {
 	config := p.ConfigCopy(redirectURI)
 
 	if p.Resource != "" {
-		return config.AuthCodeURL(state, oauth2.SetAuthURLParam("resource", p.Resource))
+		opts = append([]oauth2.AuthCodeOption{oauth2.SetAuthURLParam("resource", p.Resource)}, opts...)
 	}
 
-	return config.AuthCodeURL(state)
+	return config.AuthCodeURL(state, opts...)
 }
 
 // OAuthExchangeCode provides a base "ExchangeCode" for proiders using OAauth2
@@ -59,6 +59,7 @@ func TestOAuthProvider_OAuthGetLoginURL(t *testing.T) {
 	type args struct {
 		redirectURI string
 		state       string
+		opts        []oauth2.AuthCodeOption
 	}
 	tests := []struct {
 		name   string
@@ -89,6 +90,22 @@ func TestOAuthProvider_OAuthGetLoginURL(t *testing.T) {
 			},
 			want: "?client_id=&redirect_uri=redirectURI&response_type=code&state=state",
 		},
+		{
+			name: "test OAuthGetLoginURL with options",
+			fields: fields{
+				Config:   &oauth2.Config{},
+				Resource: "Resource",
+			},
+			args: args{
+				redirectURI: "redirectURI",
+				state:       "state",
+				opts: []oauth2.AuthCodeOption{
+					oauth2.SetAuthURLParam("prompt", "login"),
+					oauth2.SetAuthURLParam("max_age", "900"),
+				},
+			},
+			want: "?client_id=&max_age=900&prompt=login&redirect_uri=redirectURI&resource=Resource&response_type=code&state=state",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -97,7 +114,7 @@ func TestOAuthProvider_OAuthGetLoginURL(t *testing.T) {
 				Config:   tt.fields.Config,
 				ctx:      tt.fields.ctx,
 			}
-			if got := p.OAuthGetLoginURL(tt.args.redirectURI, tt.args.state); got != tt.want {
+			if got := p.OAuthGetLoginURL(tt.args.redirectURI, tt.args.state, tt.args.opts...); got != tt.want {
 				t.Errorf("OAuthProvider.OAuthGetLoginURL() = %v, want %v", got, tt.want)
 			}
 		})
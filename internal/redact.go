@@ -0,0 +1,143 @@
+package tfa
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Redaction policies
+const (
+	// RedactNone disables redaction
+	RedactNone = "none"
+	// RedactSecrets masks cookies, tokens and keys
+	RedactSecrets = "secrets"
+	// RedactAll masks everything RedactSecrets does, plus email addresses
+	RedactAll = "all"
+)
+
+const redacted = "[REDACTED]"
+
+// Log fields whose values are always masked
+var sensitiveFields = map[string]bool{
+	"access_token":  true,
+	"authorization": true,
+	"block_key":     true,
+	"client_secret": true,
+	"cookie":        true,
+	"cookies":       true,
+	"csrf_cookie":   true,
+	"hash_key":      true,
+	"id_token":      true,
+	"secret":        true,
+	"token":         true,
+}
+
+var (
+	bearerPattern = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]+=*`)
+	paramPattern  = regexp.MustCompile(`(?i)\b(access_token|id_token|refresh_token|client_secret|code|state)=[^&\s":]+`)
+	emailPattern  = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@([A-Za-z0-9.\-]+\.[A-Za-z]{2,})`)
+)
+
+// RedactHook is a logrus hook which masks secrets, and optionally email
+// addresses, in the message and fields of every log entry
+type RedactHook struct {
+	Policy string
+}
+
+// NewRedactHook creates a new RedactHook for the given policy
+func NewRedactHook(policy string) *RedactHook {
+	if policy == "" {
+		policy = RedactSecrets
+	}
+
+	return &RedactHook{Policy: policy}
+}
+
+// Levels returns the levels the hook fires on
+func (h *RedactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire masks the entry message and fields
+func (h *RedactHook) Fire(entry *logrus.Entry) error {
+	if h.Policy == RedactNone {
+		return nil
+	}
+
+	// The entry data may be shared with parent entries, so build a new map
+	// rather than modifying it in place
+	data := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		data[k] = h.redactField(k, v)
+	}
+	entry.Data = data
+	entry.Message = h.redactString(entry.Message)
+
+	return nil
+}
+
+func (h *RedactHook) redactField(key string, value interface{}) interface{} {
+	if sensitiveFields[strings.ToLower(key)] {
+		return maskValue(value)
+	}
+
+	switch v := value.(type) {
+	case string:
+		return h.redactString(v)
+	case error:
+		return errors.New(h.redactString(v.Error()))
+	}
+
+	return value
+}
+
+func (h *RedactHook) redactString(s string) string {
+	s = bearerPattern.ReplaceAllString(s, "${1}"+redacted)
+	s = paramPattern.ReplaceAllString(s, "${1}="+redacted)
+	if h.Policy == RedactAll {
+		s = emailPattern.ReplaceAllString(s, redacted+"@${1}")
+	}
+	return s
+}
+
+// Mask a value, keeping cookie names so logs remain useful
+func maskValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *http.Cookie:
+		return v.Name + "=" + redacted
+	case []*http.Cookie:
+		names := make([]string, len(v))
+		for i, c := range v {
+			names[i] = c.Name + "=" + redacted
+		}
+		return names
+	}
+
+	return redacted
+}
+
+// redactStruct masks all non-empty string fields tagged with `redact:"true"`,
+// descending into nested structs
+func redactStruct(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.Struct:
+			redactStruct(field)
+		case reflect.String:
+			if t.Field(i).Tag.Get("redact") == "true" && field.Len() > 0 {
+				field.SetString(redacted)
+			}
+		}
+	}
+}
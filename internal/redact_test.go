@@ -0,0 +1,134 @@
+package tfa
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedactHook_Fire(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		msg        string
+		fields     logrus.Fields
+		wantMsg    string
+		wantFields logrus.Fields
+	}{
+		{
+			name:   "test secrets policy",
+			policy: RedactSecrets,
+			msg:    "User Email---->user@example.com",
+			fields: logrus.Fields{
+				"cookies":     []*http.Cookie{{Name: "_forward_auth", Value: "mac|1|user@example.com"}},
+				"csrf_cookie": &http.Cookie{Name: "_forward_auth_csrf", Value: "nonce"},
+				"login_url":   "https://idp/auth?client_id=id&state=nonce%3Aoidc",
+				"error":       errors.New("GET https://idp/token?code=abc&client_secret=xyz: failed"),
+				"handler":     "Auth",
+			},
+			wantMsg: "User Email---->user@example.com",
+			wantFields: logrus.Fields{
+				"cookies":     []string{"_forward_auth=[REDACTED]"},
+				"csrf_cookie": "_forward_auth_csrf=[REDACTED]",
+				"login_url":   "https://idp/auth?client_id=id&state=[REDACTED]",
+				"error":       errors.New("GET https://idp/token?code=[REDACTED]&client_secret=[REDACTED]: failed"),
+				"handler":     "Auth",
+			},
+		},
+		{
+			name:       "test all policy",
+			policy:     RedactAll,
+			msg:        "Authorization: Bearer abc.def-ghi for user@example.com",
+			fields:     logrus.Fields{"email": "user@example.com"},
+			wantMsg:    "Authorization: Bearer [REDACTED] for [REDACTED]@example.com",
+			wantFields: logrus.Fields{"email": "[REDACTED]@example.com"},
+		},
+		{
+			name:       "test none policy",
+			policy:     RedactNone,
+			msg:        "Bearer abc",
+			fields:     logrus.Fields{"token": "abc"},
+			wantMsg:    "Bearer abc",
+			wantFields: logrus.Fields{"token": "abc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := logrus.NewEntry(logrus.New()).WithFields(tt.fields)
+			entry.Message = tt.msg
+			data := entry.Data
+
+			if err := NewRedactHook(tt.policy).Fire(entry); err != nil {
+				t.Errorf("RedactHook.Fire() error = %v", err)
+				return
+			}
+			if entry.Message != tt.wantMsg {
+				t.Errorf("RedactHook.Fire() message = %v, want %v", entry.Message, tt.wantMsg)
+			}
+			if !reflect.DeepEqual(entry.Data, tt.wantFields) {
+				t.Errorf("RedactHook.Fire() fields = %v, want %v", entry.Data, tt.wantFields)
+			}
+			if tt.policy != RedactNone && reflect.ValueOf(data).Pointer() == reflect.ValueOf(entry.Data).Pointer() {
+				t.Errorf("RedactHook.Fire() modified the original fields")
+			}
+		})
+	}
+}
+
+func TestConfig_String(t *testing.T) {
+	c := Config{
+		CookieName:         "_forward_auth",
+		CookieHashKey:      "hash-key",
+		CookieBlockKey:     "block-key",
+		SecretMgrAccessKey: "access-key",
+	}
+
+	got := c.String()
+	for _, secret := range []string{"hash-key", "block-key", "access-key"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("Config.String() = %v, leaks %v", got, secret)
+		}
+	}
+	if !strings.Contains(got, "_forward_auth") {
+		t.Errorf("Config.String() = %v, want cookie name", got)
+	}
+	if c.CookieHashKey != "hash-key" {
+		t.Errorf("Config.String() modified the config")
+	}
+}
+
+func TestConfig_jsonLog(t *testing.T) {
+	c := &Config{
+		CookieName:             "_forward_auth",
+		CookieHashKey:          "hash-key",
+		CookieBlockKey:         "block-key",
+		PreviousCookieHashKey:  "previous-hash-key",
+		PreviousCookieBlockKey: "previous-block-key",
+		SecretMgrSecretKey:     "aws-secret-key",
+	}
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.AddHook(NewRedactHook(RedactSecrets))
+	logger.WithField("config", c).Info("Starting with config")
+
+	got := buf.String()
+	for _, secret := range []string{"hash-key", "block-key", "previous-hash-key", "previous-block-key", "aws-secret-key"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("JSON log = %v, leaks %v", got, secret)
+		}
+	}
+	if !strings.Contains(got, "_forward_auth") {
+		t.Errorf("JSON log = %v, want cookie name", got)
+	}
+	if c.CookieHashKey != "hash-key" {
+		t.Errorf("logging modified the config")
+	}
+}
@@ -0,0 +1,162 @@
+package tfa
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Reloader reloads the config when the config file changes or a SIGHUP is
+// received, and refreshes the secrets so rotated keys are picked up
+type Reloader struct {
+	args            []string
+	sec             SecretsMgr
+	server          *Server
+	file            string
+	interval        time.Duration
+	secretsInterval time.Duration
+}
+
+// NewReloaderFromArgs creates a reloader for the server's config, parsed
+// from command arguments
+func NewReloaderFromArgs(server *Server) *Reloader {
+	var sec secretsMgr
+	return NewReloader(os.Args[1:], sec, server, server.config)
+}
+
+// NewReloader creates a reloader which re-parses args into a new config for
+// the server, watching the config file referenced by current
+func NewReloader(args []string, sec SecretsMgr, server *Server, current *Config) *Reloader {
+	rl := &Reloader{
+		args:     args,
+		sec:      sec,
+		server:   server,
+		file:     current.configFile,
+		interval: time.Second * time.Duration(current.ConfigReloadInterval),
+	}
+
+	// Env vars can't change while running, so there's nothing to refresh
+	if current.secretsBackendName() != "env" {
+		rl.secretsInterval = time.Second * time.Duration(current.SecretsRefreshInterval)
+	}
+
+	return rl
+}
+
+// Reload parses and validates a new config and swaps it into the server.
+// Invalid configs are rejected, leaving the current config in place
+func (rl *Reloader) Reload() error {
+	c, err := NewConfig(rl.args, rl.sec)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Check(); err != nil {
+		return err
+	}
+
+	if err := rl.server.Reload(c); err != nil {
+		return err
+	}
+
+	// Pick up any logging changes
+	NewDefaultLogger(c.LogOptions())
+	return nil
+}
+
+// RefreshSecrets fetches the secrets for the server's current config again,
+// swapping them in if the keys, secret or client secret have been rotated,
+// returning whether they were
+func (rl *Reloader) RefreshSecrets() (bool, error) {
+	current := rl.server.active().config
+
+	c := *current
+	if err := c.loadSecrets(rl.sec); err != nil {
+		return false, err
+	}
+
+	if c.CookieHashKey == current.CookieHashKey && c.CookieBlockKey == current.CookieBlockKey &&
+		c.PreviousCookieHashKey == current.PreviousCookieHashKey && c.PreviousCookieBlockKey == current.PreviousCookieBlockKey &&
+		c.SecretString == current.SecretString && c.Providers.OIDC.ClientSecret == current.Providers.OIDC.ClientSecret {
+		return false, nil
+	}
+
+	// The provider's oauth2 config holds the client secret it was set up
+	// with, the copy's provider is set up again so the current one is
+	// left untouched
+	if c.Providers.OIDC.ClientSecret != current.Providers.OIDC.ClientSecret {
+		if err := c.setupProvider("oidc"); err != nil {
+			return false, err
+		}
+	}
+
+	return true, rl.server.Reload(&c)
+}
+
+// Run reloads the config whenever it changes, until stop is closed
+func (rl *Reloader) Run(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// Poll the config file for changes, if there is one
+	var tick <-chan time.Time
+	if rl.file != "" && rl.interval > 0 {
+		ticker := time.NewTicker(rl.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	modTime := rl.modTime()
+
+	// Poll the secrets backend for rotated keys
+	var refresh <-chan time.Time
+	if rl.secretsInterval > 0 {
+		ticker := time.NewTicker(rl.secretsInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			log.Info("Received SIGHUP, reloading config")
+		case <-tick:
+			t := rl.modTime()
+			if t.Equal(modTime) {
+				continue
+			}
+			modTime = t
+			log.WithField("file", rl.file).Info("Config file changed, reloading config")
+		case <-refresh:
+			rotated, err := rl.RefreshSecrets()
+			if err != nil {
+				log.WithField("error", err).Error("Unable to refresh secrets, keeping the current keys")
+			} else if rotated {
+				log.Info("Secrets rotated, refreshed cookie keys")
+			}
+			continue
+		}
+
+		if err := rl.Reload(); err != nil {
+			log.WithField("error", err).Error("Invalid config, keeping the current config")
+			continue
+		}
+		log.Info("Reloaded config")
+	}
+}
+
+func (rl *Reloader) modTime() time.Time {
+	if rl.file == "" {
+		return time.Time{}
+	}
+
+	info, err := os.Stat(rl.file)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
@@ -0,0 +1,379 @@
+package tfa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/rajasoun/traefik-forward-auth/internal/provider"
+	"golang.org/x/oauth2"
+)
+
+// newMockIssuer serves the OIDC discovery document so providers can be set
+// up without network access
+func newMockIssuer() *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%[1]s/auth","token_endpoint":"%[1]s/token","jwks_uri":"%[1]s/keys"}`, srv.URL)
+	}))
+	return srv
+}
+
+func setupReloadTest(t *testing.T, contents string) (*Reloader, string, func()) {
+	issuer := newMockIssuer()
+
+	dir, err := ioutil.TempDir("", "tfa-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "config.ini")
+	if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{
+		"--config=" + file,
+		"--cookie-hash-key=AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+		"--cookie-block-key=R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+		"--default-provider=oidc",
+		"--providers.oidc.issuer-url=" + issuer.URL,
+		"--providers.oidc.client-id=id",
+		"--providers.oidc.client-secret=secret",
+	}
+	config, err := NewConfig(args, mockSecretsMgr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rl := NewReloader(args, mockSecretsMgr{}, server, config)
+	return rl, file, func() {
+		issuer.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReloader_Reload(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  bool
+		wantCode int
+	}{
+		{
+			name:     "test valid config",
+			contents: "secret=abc\ndefault-action=auth\nrule.public.action=allow\nrule.public.rule=PathPrefix(`/public`)\n",
+			wantErr:  false,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "test invalid rule action",
+			contents: "secret=abc\nrule.public.action=invalid\nrule.public.rule=PathPrefix(`/public`)\n",
+			wantErr:  true,
+			wantCode: http.StatusTemporaryRedirect,
+		},
+		{
+			name:     "test invalid rule",
+			contents: "secret=abc\nrule.public.action=allow\nrule.public.rule=PathPrefix(\n",
+			wantErr:  true,
+			wantCode: http.StatusTemporaryRedirect,
+		},
+		{
+			name:     "test missing secret",
+			contents: "rule.public.action=allow\nrule.public.rule=PathPrefix(`/public`)\n",
+			wantErr:  true,
+			wantCode: http.StatusTemporaryRedirect,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl, file, teardown := setupReloadTest(t, "secret=abc\n")
+			defer teardown()
+			previous := rl.server.active().config
+
+			if err := ioutil.WriteFile(file, []byte(tt.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := rl.Reload()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Reloader.Reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && rl.server.active().config != previous {
+				t.Errorf("Reloader.Reload() replaced the config with an invalid one")
+			}
+
+			w := httptest.NewRecorder()
+			rl.server.RootHandler(w, newForwardedRequest("GET", "example.com", "/public"))
+			if w.Code != tt.wantCode {
+				t.Errorf("RootHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestReloader_Run(t *testing.T) {
+	rl, file, teardown := setupReloadTest(t, "secret=abc\n")
+	defer teardown()
+	rl.interval = 10 * time.Millisecond
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		rl.Run(stop)
+		close(done)
+	}()
+
+	// Ensure the modification time changes
+	time.Sleep(20 * time.Millisecond)
+	contents := "secret=abc\nrule.public.action=allow\nrule.public.rule=PathPrefix(`/public`)\n"
+	if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Second))
+
+	code := 0
+	for i := 0; i < 100 && code != http.StatusOK; i++ {
+		time.Sleep(10 * time.Millisecond)
+		w := httptest.NewRecorder()
+		rl.server.RootHandler(w, newForwardedRequest("GET", "example.com", "/public"))
+		code = w.Code
+	}
+	if code != http.StatusOK {
+		t.Errorf("Reloader.Run() did not reload the changed config")
+	}
+
+	close(stop)
+	<-done
+}
+
+func TestServer_Reload_inFlight(t *testing.T) {
+	called, release := make(chan struct{}), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(called)
+		<-release
+		fmt.Fprint(w, `{"allow":true}`)
+	}))
+	defer slow.Close()
+
+	newConfig := func(rules map[string]*Rule) *Config {
+		return &Config{
+			Path:            "/_oauth",
+			Secret:          []byte("secret"),
+			Lifetime:        time.Hour,
+			CookieName:      "_forward_auth",
+			CSRFCookieName:  "_forward_auth_csrf",
+			UserInfoCookie:  "_user_info",
+			DefaultAction:   "auth",
+			DefaultProvider: "oidc",
+			Rules:           rules,
+			Providers: provider.Providers{
+				OIDC: provider.OIDC{
+					OAuthProvider: provider.OAuthProvider{Config: &oauth2.Config{}},
+				},
+			},
+		}
+	}
+	s, err := NewServer(newConfig(map[string]*Rule{
+		"slow": {Action: "auth", Rule: "PathPrefix(`/slow`)", Provider: "oidc", Webhook: slow.URL},
+	}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a request which blocks in the webhook
+	r := newForwardedRequest("GET", "example.com", "/slow")
+	r.AddCookie(s.auth.MakeCookie(r, "test@example.com"))
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		s.RootHandler(w, r)
+		close(done)
+	}()
+	<-called
+
+	// Neither the reload nor new requests should wait for it
+	next := newConfig(map[string]*Rule{
+		"public": {Action: "allow", Rule: "PathPrefix(`/public`)", Provider: "oidc"},
+	})
+	reloaded := make(chan int)
+	go func() {
+		if err := s.Reload(next); err != nil {
+			t.Error(err)
+		}
+		w := httptest.NewRecorder()
+		s.RootHandler(w, newForwardedRequest("GET", "example.com", "/public"))
+		reloaded <- w.Code
+	}()
+	select {
+	case code := <-reloaded:
+		if code != http.StatusOK {
+			t.Errorf("RootHandler() code = %v after reload, want %v", code, http.StatusOK)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Server.Reload() blocked by an in-flight request")
+	}
+
+	// The in-flight request completes with the previous config
+	close(release)
+	<-done
+	if w.Code != http.StatusOK {
+		t.Errorf("in-flight RootHandler() code = %v, want %v", w.Code, http.StatusOK)
+	}
+}
+
+// rotatingSecretsMgr returns keys which can be changed, as if rotated, using
+// the same 16 byte value for the hash and block keys
+type rotatingSecretsMgr struct {
+	mockSecretsMgr
+	current  *string
+	previous *string
+}
+
+func (m rotatingSecretsMgr) getSecret(svc secretsmanageriface.SecretsManagerAPI, secretName string) (*Secrets, error) {
+	return &Secrets{HashKey: *m.current, BlockKey: *m.current}, nil
+}
+
+func (m rotatingSecretsMgr) getSecretStage(svc secretsmanageriface.SecretsManagerAPI, secretName, versionStage string) (*Secrets, error) {
+	return &Secrets{HashKey: *m.previous, BlockKey: *m.previous}, nil
+}
+
+func TestReloader_RefreshSecrets(t *testing.T) {
+	rl, _, teardown := setupReloadTest(t, "secret=abc\n")
+	defer teardown()
+
+	current, previous := "first-key-000000", ""
+	rl.sec = rotatingSecretsMgr{current: &current, previous: &previous}
+	rl.server.config.SecretMgrSecretName = "traefik-forward-auth"
+
+	r := newForwardedRequest("GET", "example.com", "/")
+	if _, err := rl.RefreshSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := rl.server.active().auth.MakeUserCookie(r, "test@example.com|Test|User")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		current     string
+		previous    string
+		wantRotated bool
+		wantValid   bool
+	}{
+		{
+			name:        "test unchanged keys",
+			current:     "first-key-000000",
+			wantRotated: false,
+			wantValid:   true,
+		},
+		{
+			name:        "test rotated keys",
+			current:     "second-key-00000",
+			previous:    "first-key-000000",
+			wantRotated: true,
+			wantValid:   true,
+		},
+		{
+			name:        "test rotated twice",
+			current:     "third-key-000000",
+			previous:    "second-key-00000",
+			wantRotated: true,
+			wantValid:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current, previous = tt.current, tt.previous
+			rotated, err := rl.RefreshSecrets()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated != tt.wantRotated {
+				t.Errorf("Reloader.RefreshSecrets() = %v, want %v", rotated, tt.wantRotated)
+			}
+			if rl.server.active().config.CookieHashKey != tt.current {
+				t.Errorf("Reloader.RefreshSecrets() hash key = %v, want %v", rl.server.active().config.CookieHashKey, tt.current)
+			}
+
+			req := newForwardedRequest("GET", "example.com", "/")
+			req.AddCookie(cookie)
+			_, err = rl.server.active().auth.ReadUserCookie(req)
+			if (err == nil) != tt.wantValid {
+				t.Errorf("ReadUserCookie() error = %v, want valid %v", err, tt.wantValid)
+			}
+		})
+	}
+}
+
+func TestReloader_RefreshSecrets_clientSecret(t *testing.T) {
+	issuer := newMockIssuer()
+	defer issuer.Close()
+
+	dir, err := ioutil.TempDir("", "tfa-refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "secrets.enc")
+	writeSecrets := func(clientSecret string) {
+		encrypted, err := EncryptSecrets("file-key", []byte(`{"hash-key":"first-key-000000","block-key":"first-key-000000","client-secret":"`+clientSecret+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(encrypted), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSecrets("first-client-secret")
+
+	args := []string{
+		"--secret=abc",
+		"--default-provider=oidc",
+		"--providers.oidc.issuer-url=" + issuer.URL,
+		"--providers.oidc.client-id=id",
+		"--encrypted-secrets-file=" + file,
+		"--encrypted-secrets-key=file-key",
+	}
+	config, err := NewConfig(args, mockSecretsMgr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Check(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := NewReloader(args, mockSecretsMgr{}, server, config)
+
+	writeSecrets("second-client-secret")
+	rotated, err := rl.RefreshSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rotated {
+		t.Errorf("Reloader.RefreshSecrets() = false, want true")
+	}
+	oidc := rl.server.active().config.Providers.OIDC
+	if oidc.ClientSecret != "second-client-secret" || oidc.Config.ClientSecret != "second-client-secret" {
+		t.Errorf("Reloader.RefreshSecrets() client secret = %v, oauth2 %v, want second-client-secret", oidc.ClientSecret, oidc.Config.ClientSecret)
+	}
+	if config.Providers.OIDC.Config.ClientSecret != "first-client-secret" {
+		t.Errorf("Reloader.RefreshSecrets() modified the previous config's oauth2 client secret")
+	}
+}
@@ -0,0 +1,307 @@
+package tfa
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Secrets are the values fetched from a secrets backend. The secret and
+// client secret are optional, and only used when not otherwise configured
+type Secrets struct {
+	HashKey      string `json:"hash-key,omitempty"`
+	BlockKey     string `json:"block-key,omitempty"`
+	Secret       string `json:"secret,omitempty"`
+	ClientSecret string `json:"client-secret,omitempty"`
+
+	// The keys before the last rotation, still accepted when decoding
+	PreviousHashKey  string `json:"previous-hash-key,omitempty"`
+	PreviousBlockKey string `json:"previous-block-key,omitempty"`
+}
+
+// SecretsBackend fetches secrets from where they are stored
+type SecretsBackend interface {
+	Secrets(c *Config) (*Secrets, error)
+}
+
+// secretsBackends creates the backends selectable by the "secrets-backend"
+// option. Only aws uses sec, which is replaced by a mock in tests
+var secretsBackends = map[string]func(sec SecretsMgr) SecretsBackend{
+	"aws":   func(sec SecretsMgr) SecretsBackend { return awsBackend{sec} },
+	"vault": func(SecretsMgr) SecretsBackend { return vaultBackend{} },
+	"file":  func(SecretsMgr) SecretsBackend { return fileBackend{} },
+	"env":   func(SecretsMgr) SecretsBackend { return envBackend{} },
+}
+
+// Vault holds the options of the Vault KV v2 secrets backend
+type Vault struct {
+	Addr  string `long:"addr" env:"ADDR" description:"Vault address, e.g. https://vault:8200"`
+	Token string `long:"token" env:"TOKEN" description:"Vault token" json:"-" redact:"true" secret:"true"`
+	Mount string `long:"mount" env:"MOUNT" default:"secret" description:"Vault KV v2 secrets engine mount"`
+	Path  string `long:"path" env:"PATH" description:"Path of the secret within the mount"`
+}
+
+// secretsBackendName resolves "auto" to the backend whose options are set,
+// falling back to env
+func (c *Config) secretsBackendName() string {
+	if c.SecretsBackend != "" && c.SecretsBackend != "auto" {
+		return c.SecretsBackend
+	}
+
+	switch {
+	case c.SecretMgrSecretName != "" || c.SecretMgrParameterName != "":
+		return "aws"
+	case c.Vault.Addr != "" && c.Vault.Path != "":
+		return "vault"
+	case c.EncryptedSecretsFile != "":
+		return "file"
+	}
+	return "env"
+}
+
+// loadSecrets fetches the cookie keys from the secrets backend, along with
+// the secret and client secret when they are not otherwise configured or
+// were fetched from the backend before
+func (c *Config) loadSecrets(sec SecretsMgr) error {
+	name := c.secretsBackendName()
+	newBackend, ok := secretsBackends[name]
+	if !ok {
+		return fmt.Errorf("unknown secrets backend: %s", name)
+	}
+
+	s, err := newBackend(sec).Secrets(c)
+	if err != nil {
+		return fmt.Errorf("%s secrets backend: %w", name, err)
+	}
+
+	c.CookieHashKey, c.CookieBlockKey = s.HashKey, s.BlockKey
+	c.PreviousCookieHashKey, c.PreviousCookieBlockKey = s.PreviousHashKey, s.PreviousBlockKey
+	if (c.SecretString == "" || c.backendSecret) && s.Secret != "" {
+		c.SecretString = s.Secret
+		c.Secret = []byte(s.Secret)
+		c.backendSecret = true
+	}
+	if (c.Providers.OIDC.ClientSecret == "" || c.backendClientSecret) && s.ClientSecret != "" {
+		c.Providers.OIDC.ClientSecret = s.ClientSecret
+		c.backendClientSecret = true
+	}
+
+	return nil
+}
+
+// awsBackend reads secrets from AWS Secrets Manager, including the previous
+// version so cookies survive rotation, or SSM Parameter Store when a
+// parameter name is given
+type awsBackend struct {
+	sec SecretsMgr
+}
+
+func (b awsBackend) Secrets(c *Config) (*Secrets, error) {
+	if c.SecretMgrParameterName != "" {
+		svc, err := b.sec.getSsmClient(c.SecretMgrAccessKey, c.SecretMgrSecretKey, c.SecretMgrSessionToken, c.SecretMgrRegion, c.SecretMgrRoleARN)
+		if err != nil {
+			return nil, err
+		}
+
+		return b.sec.getParameter(svc, c.SecretMgrParameterName)
+	}
+
+	svc, err := b.sec.getAwsSession(c.SecretMgrAccessKey, c.SecretMgrSecretKey, c.SecretMgrSessionToken, c.SecretMgrRegion, c.SecretMgrRoleARN)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := b.sec.getSecret(svc, c.SecretMgrSecretName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Previous keys in the secret itself take precedence over the version
+	// before the last rotation
+	if s.PreviousHashKey == "" && s.PreviousBlockKey == "" {
+		previous, err := b.sec.getSecretStage(svc, c.SecretMgrSecretName, "AWSPREVIOUS")
+		if err != nil {
+			return nil, err
+		}
+		s.PreviousHashKey, s.PreviousBlockKey = previous.HashKey, previous.BlockKey
+	}
+	return s, nil
+}
+
+// vaultBackend reads secrets from a Vault KV v2 secrets engine
+type vaultBackend struct{}
+
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func (vaultBackend) Secrets(c *Config) (*Secrets, error) {
+	if c.Vault.Addr == "" || c.Vault.Path == "" {
+		return nil, errors.New("vault.addr and vault.path must be set")
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimRight(c.Vault.Addr, "/"),
+		strings.Trim(c.Vault.Mount, "/"), strings.TrimLeft(c.Vault.Path, "/"))
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.Vault.Token)
+
+	res, err := vaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Errors []string `json:"errors"`
+		Data   struct {
+			Data Secrets `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil && res.StatusCode == http.StatusOK {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s %s", url, res.Status, strings.Join(body.Errors, ", "))
+	}
+
+	return &body.Data.Data, nil
+}
+
+// fileBackend reads secrets from a local file, encrypted with AES-GCM
+type fileBackend struct{}
+
+func (fileBackend) Secrets(c *Config) (*Secrets, error) {
+	b, err := ioutil.ReadFile(c.EncryptedSecretsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := decryptSecrets(c.EncryptedSecretsKey, string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.EncryptedSecretsFile, err)
+	}
+
+	s := &Secrets{}
+	if err := json.Unmarshal(plaintext, s); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.EncryptedSecretsFile, err)
+	}
+	return s, nil
+}
+
+// secretsCipher creates the AES-GCM cipher for key, which may be any length
+func secretsCipher(key string) (cipher.AEAD, error) {
+	if key == "" {
+		return nil, errors.New("encrypted-secrets-key must be set")
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSecrets encrypts plaintext with key, returning the base64 encoded
+// nonce and ciphertext as read by the file secrets backend
+func EncryptSecrets(key string, plaintext []byte) (string, error) {
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func decryptSecrets(key, encoded string) ([]byte, error) {
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("encrypted secrets too short")
+	}
+
+	return gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+}
+
+// envBackend reads the cookie keys from the cookie-hash-key and
+// cookie-block-key options, for when the secret and client secret are
+// already set as options
+type envBackend struct{}
+
+func (envBackend) Secrets(c *Config) (*Secrets, error) {
+	if err := validateCookieKeys(c.CookieHashKey, c.CookieBlockKey); err != nil {
+		return nil, err
+	}
+
+	return &Secrets{
+		HashKey:  c.CookieHashKey,
+		BlockKey: c.CookieBlockKey,
+	}, nil
+}
+
+// validateCookieKeys checks the keys can encode cookies, which needs a hash
+// key and an AES-128, AES-192 or AES-256 block key
+func validateCookieKeys(hashKey, blockKey string) error {
+	if hashKey == "" || blockKey == "" {
+		return errors.New("\"cookie-hash-key\" and \"cookie-block-key\" must be set")
+	}
+
+	switch len(blockKey) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("\"cookie-block-key\" must be 16, 24 or 32 bytes, not %d", len(blockKey))
+}
+
+// SecretsCommand runs the secrets encrypt command, encrypting the JSON
+// secrets read from r for the file secrets backend and writing them to w
+func SecretsCommand(args []string, r io.Reader, w io.Writer) int {
+	opts := map[string]string{"key": os.Getenv("ENCRYPTED_SECRETS_KEY")}
+	if len(args) == 0 || args[0] != "encrypt" || len(extractArgs(args[1:], opts)) > 0 {
+		fmt.Fprintln(w, "usage: secrets encrypt [--key=<key>] < secrets.json > secrets.enc")
+		return 2
+	}
+
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	if err := json.Unmarshal(plaintext, &Secrets{}); err != nil {
+		fmt.Fprintln(w, "invalid secrets:", err)
+		return 1
+	}
+
+	encrypted, err := EncryptSecrets(opts["key"], plaintext)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+
+	fmt.Fprintln(w, encrypted)
+	return 0
+}
@@ -0,0 +1,277 @@
+package tfa
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+type mockKeysSecretsMgr struct {
+	mockSecretsMgr
+}
+
+func (mockKeysSecretsMgr) getSecret(svc secretsmanageriface.SecretsManagerAPI, secretName string) (*Secrets, error) {
+	return &Secrets{HashKey: "aws-hash", BlockKey: "aws-block"}, nil
+}
+
+func (mockKeysSecretsMgr) getParameter(svc ssmiface.SSMAPI, parameterName string) (*Secrets, error) {
+	return &Secrets{HashKey: "ssm-hash", BlockKey: "ssm-block"}, nil
+}
+
+// mockClientSecretsMgr reads secrets with the mock AWS clients
+type mockClientSecretsMgr struct {
+	secretsMgr
+}
+
+func (mockClientSecretsMgr) getAwsSession(secretMgrAccessKey, secretMgrSecretKey, secretMgrSessionToken, secretMgrRegion, secretMgrRoleARN string) (secretsmanageriface.SecretsManagerAPI, error) {
+	return &mockSecretsManagerClient{}, nil
+}
+
+func (mockClientSecretsMgr) getSsmClient(secretMgrAccessKey, secretMgrSecretKey, secretMgrSessionToken, secretMgrRegion, secretMgrRoleARN string) (ssmiface.SSMAPI, error) {
+	return &mockSSMClient{value: aws.String(`{"hash-key":"HashKey","block-key":"BlockKey","secret":"Secret","client-secret":"ClientSecret"}`)}, nil
+}
+
+func TestAwsBackend_Secrets(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		want   *Secrets
+	}{
+		{
+			name:   "test secrets manager",
+			config: &Config{SecretMgrSecretName: secretName},
+			want: &Secrets{
+				HashKey:          "HashKey",
+				BlockKey:         "BlockKey",
+				Secret:           "Secret",
+				ClientSecret:     "ClientSecret",
+				PreviousHashKey:  "PreviousHashKey",
+				PreviousBlockKey: "PreviousBlockKey",
+			},
+		},
+		{
+			name:   "test parameter store",
+			config: &Config{SecretMgrParameterName: "/traefik-forward-auth/keys"},
+			want: &Secrets{
+				HashKey:      "HashKey",
+				BlockKey:     "BlockKey",
+				Secret:       "Secret",
+				ClientSecret: "ClientSecret",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := awsBackend{sec: mockClientSecretsMgr{}}.Secrets(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("awsBackend.Secrets() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_loadSecrets(t *testing.T) {
+	setup(t)
+	os.Setenv("COOKIE_HASH_KEY", "env-hash-key-000")
+	os.Setenv("COOKIE_BLOCK_KEY", "env-block-key-00")
+	defer os.Unsetenv("COOKIE_HASH_KEY")
+	defer os.Unsetenv("COOKIE_BLOCK_KEY")
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if r.URL.Path != "/v1/kv/data/tfa" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"hash-key":"vault-hash","block-key":"vault-block","secret":"vault-secret","client-secret":"vault-client-secret"}}}`))
+	}))
+	defer vault.Close()
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	encrypted, err := EncryptSecrets("file-key", []byte(`{"hash-key":"file-hash","block-key":"file-block","secret":"file-secret"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "secrets.enc")
+	if err := ioutil.WriteFile(file, []byte(encrypted+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		args             []string
+		wantHashKey      string
+		wantBlockKey     string
+		wantSecret       string
+		wantClientSecret string
+		wantErr          bool
+	}{
+		{
+			name:         "test auto selects env",
+			args:         []string{"--secret=flag-secret"},
+			wantHashKey:  "env-hash-key-000",
+			wantBlockKey: "env-block-key-00",
+			wantSecret:   "flag-secret",
+		},
+		{
+			name:         "test env keys as flags",
+			args:         []string{"--secret=flag-secret", "--cookie-hash-key=flag-hash-key-00", "--cookie-block-key=flag-block-key-0"},
+			wantHashKey:  "flag-hash-key-00",
+			wantBlockKey: "flag-block-key-0",
+			wantSecret:   "flag-secret",
+		},
+		{
+			name:    "test env missing key",
+			args:    []string{"--secret=flag-secret", "--cookie-hash-key="},
+			wantErr: true,
+		},
+		{
+			name:    "test env invalid block key length",
+			args:    []string{"--secret=flag-secret", "--cookie-block-key=short"},
+			wantErr: true,
+		},
+		{
+			name:         "test auto selects aws",
+			args:         []string{"--secret=flag-secret", "--secret-mgr-secret-name=tfa"},
+			wantHashKey:  "aws-hash",
+			wantBlockKey: "aws-block",
+			wantSecret:   "flag-secret",
+		},
+		{
+			name:         "test auto selects aws parameter store",
+			args:         []string{"--secret=flag-secret", "--secret-mgr-parameter-name=/tfa/keys"},
+			wantHashKey:  "ssm-hash",
+			wantBlockKey: "ssm-block",
+			wantSecret:   "flag-secret",
+		},
+		{
+			name:             "test auto selects vault",
+			args:             []string{"--vault.addr=" + vault.URL, "--vault.token=token", "--vault.mount=kv", "--vault.path=tfa"},
+			wantHashKey:      "vault-hash",
+			wantBlockKey:     "vault-block",
+			wantSecret:       "vault-secret",
+			wantClientSecret: "vault-client-secret",
+		},
+		{
+			name:             "test configured secrets take precedence",
+			args:             []string{"--secret=flag-secret", "--providers.oidc.client-secret=flag-client-secret", "--vault.addr=" + vault.URL, "--vault.token=token", "--vault.mount=kv", "--vault.path=tfa"},
+			wantHashKey:      "vault-hash",
+			wantBlockKey:     "vault-block",
+			wantSecret:       "flag-secret",
+			wantClientSecret: "flag-client-secret",
+		},
+		{
+			name:    "test vault error",
+			args:    []string{"--vault.addr=" + vault.URL, "--vault.token=wrong", "--vault.path=tfa"},
+			wantErr: true,
+		},
+		{
+			name:         "test auto selects file",
+			args:         []string{"--encrypted-secrets-file=" + file, "--encrypted-secrets-key=file-key"},
+			wantHashKey:  "file-hash",
+			wantBlockKey: "file-block",
+			wantSecret:   "file-secret",
+		},
+		{
+			name:    "test file wrong key",
+			args:    []string{"--encrypted-secrets-file=" + file, "--encrypted-secrets-key=wrong"},
+			wantErr: true,
+		},
+		{
+			name:    "test explicit backend",
+			args:    []string{"--secrets-backend=vault"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewConfig(tt.args, mockKeysSecretsMgr{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if c.CookieHashKey != tt.wantHashKey || c.CookieBlockKey != tt.wantBlockKey {
+				t.Errorf("NewConfig() keys = %s, %s, want %s, %s", c.CookieHashKey, c.CookieBlockKey, tt.wantHashKey, tt.wantBlockKey)
+			}
+			if string(c.Secret) != tt.wantSecret {
+				t.Errorf("NewConfig() secret = %s, want %s", c.Secret, tt.wantSecret)
+			}
+			if c.Providers.OIDC.ClientSecret != tt.wantClientSecret {
+				t.Errorf("NewConfig() client secret = %s, want %s", c.Providers.OIDC.ClientSecret, tt.wantClientSecret)
+			}
+		})
+	}
+}
+
+func TestSecretsCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		input    string
+		wantCode int
+	}{
+		{
+			name:     "test encrypt",
+			args:     []string{"encrypt", "--key=key"},
+			input:    `{"hash-key":"hash"}`,
+			wantCode: 0,
+		},
+		{
+			name:     "test invalid secrets",
+			args:     []string{"encrypt", "--key=key"},
+			input:    `hash`,
+			wantCode: 1,
+		},
+		{
+			name:     "test missing key",
+			args:     []string{"encrypt"},
+			input:    `{}`,
+			wantCode: 1,
+		},
+		{
+			name:     "test usage",
+			args:     []string{},
+			wantCode: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w bytes.Buffer
+			if got := SecretsCommand(tt.args, strings.NewReader(tt.input), &w); got != tt.wantCode {
+				t.Fatalf("SecretsCommand() = %v, want %v: %s", got, tt.wantCode, w.String())
+			}
+			if tt.wantCode != 0 {
+				return
+			}
+
+			plaintext, err := decryptSecrets("key", w.String())
+			if err != nil || string(plaintext) != tt.input {
+				t.Errorf("SecretsCommand() decrypted = %s, %v, want %s", plaintext, err, tt.input)
+			}
+		})
+	}
+}
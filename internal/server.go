@@ -1,66 +1,184 @@
 package tfa
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/containous/traefik/v2/pkg/rules"
 	"github.com/rajasoun/traefik-forward-auth/internal/provider"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 )
 
 // Server contains router and handler methods
 type Server struct {
+	// current holds the *Server built by the latest Reload, requests are
+	// served by it so a reload never waits for, or stalls, requests
+	current atomic.Value
+
+	config *Config
+	auth   *Auth
 	router *rules.Router
+	pages  *Pages
+	log    *logrus.Logger
+
+	// clientNets are the address ranges of the rules' ClientIP matchers
+	clientNets []*net.IPNet
+
+	webhooks *webhooks
+}
+
+// NewServer creates a new server object for the given config and builds
+// router, logging to logger or the default logger if nil
+func NewServer(config *Config, logger *logrus.Logger) (*Server, error) {
+	if logger == nil {
+		logger = log
+	}
+
+	s := &Server{
+		config:     config,
+		auth:       NewAuth(config),
+		log:        logger,
+		clientNets: config.clientNets(),
+		webhooks:   newWebhooks(config),
+	}
+
+	var err error
+	s.router, err = s.buildRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	s.pages, err = NewPages(s.config.TemplateDir, s.config.Branding)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, warning := range s.config.ruleWarnings() {
+		s.log.Warn(warning)
+	}
+
+	return s, nil
 }
 
-// NewServer creates a new server object and builds router
-func NewServer() *Server {
-	s := &Server{}
-	s.buildRoutes()
+// Reload swaps in a new, validated, config and rebuilds the router, pages and
+// webhooks, with an empty decision cache, from it. Requests already in flight
+// complete using the previous config, and if the router can't be built from
+// the new config the previous config is kept
+func (s *Server) Reload(c *Config) error {
+	next, err := NewServer(c, s.log)
+	if err != nil {
+		return err
+	}
+
+	// next is never modified once built, so requests can use it without
+	// holding a lock
+	s.current.Store(next)
+	return nil
+}
+
+// active returns the server built from the latest config, which is s itself
+// until the first reload
+func (s *Server) active() *Server {
+	if next, ok := s.current.Load().(*Server); ok {
+		return next
+	}
 	return s
 }
 
-func (s *Server) buildRoutes() {
-	var err error
-	s.router, err = rules.NewRouter()
+func (s *Server) buildRoutes() (*rules.Router, error) {
+	return s.newRouter(s.ruleHandler, s.pathHandler)
+}
+
+// newRouter builds a router from the rules, with ruleHandler handling the
+// requests matched by each rule, or by the default rule, and pathHandler the
+// requests to the callback, logout, choose and login paths
+func (s *Server) newRouter(ruleHandler func(name string, rule *Rule) http.Handler, pathHandler func(path string) http.Handler) (*rules.Router, error) {
+	router, err := rules.NewRouter()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	// Let's build a router
-	for name, rule := range config.Rules {
-		matchRule := rule.formattedRule()
-		if rule.Action == "allow" {
-			s.router.AddRoute(matchRule, 1, s.AllowHandler(name))
-		} else {
-			s.router.AddRoute(matchRule, 1, s.AuthHandler(rule.Provider, name))
+	// Routes are matched in the order they're added, so add the rules in
+	// order of priority
+	for _, name := range s.config.sortedRuleNames() {
+		rule := s.config.Rules[name]
+		err = router.AddRoute(rule.formattedRule(), rule.Priority, ruleHandler(name, rule))
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", name, err)
 		}
 	}
 
-	// Add callback handler
-	s.router.Handle(config.Path, s.AuthCallbackHandler())
-
-	// Add logout handler
-	s.router.Handle(config.Path+"/logout", s.LogoutHandler())
+	// Add callback, logout, provider chooser and login handlers
+	for _, path := range []string{"", "/logout", "/choose", "/login"} {
+		router.Handle(s.config.Path+path, pathHandler(path))
+	}
 
 	// Add a default handler
-	if config.DefaultAction == "allow" {
-		s.router.NewRoute().Handler(s.AllowHandler("default"))
-	} else {
-		s.router.NewRoute().Handler(s.AuthHandler(config.DefaultProvider, "default"))
+	router.NewRoute().Handler(ruleHandler("default", s.defaultRule()))
+
+	return router, nil
+}
+
+// defaultRule is the rule applied to requests matching no other rule
+func (s *Server) defaultRule() *Rule {
+	return &Rule{
+		Action:   s.config.DefaultAction,
+		Provider: s.config.DefaultProvider,
+	}
+}
+
+// ruleHandler returns the handler for requests matching the rule
+func (s *Server) ruleHandler(name string, rule *Rule) http.Handler {
+	switch rule.Action {
+	case "allow":
+		return s.AllowHandler(name)
+	case "deny":
+		return s.DenyHandler(name)
+	case "identify":
+		return s.IdentifyHandler(name)
+	}
+	return s.AuthHandler(rule.Provider, name)
+}
+
+// pathHandler returns the handler for one of the auth server's own paths,
+// relative to the callback path
+func (s *Server) pathHandler(path string) http.Handler {
+	switch path {
+	case "/logout":
+		return s.LogoutHandler()
+	case "/choose":
+		return s.ChooseHandler()
+	case "/login":
+		return s.LoginHandler()
 	}
+	return s.AuthCallbackHandler()
 }
 
 // RootHandler Overwrites the request method, host and URL with those from the
 // forwarded request so it's correctly routed by mux
 func (s *Server) RootHandler(w http.ResponseWriter, r *http.Request) {
+	s = s.active()
+
 	// Modify request
 	r.Method = r.Header.Get("X-Forwarded-Method")
 	r.Host = r.Header.Get("X-Forwarded-Host")
 	r.URL, _ = url.Parse(r.Header.Get("X-Forwarded-Uri"))
 
+	// Ensure every request can be correlated between logs and error pages
+	if r.Header.Get("X-Request-Id") == "" {
+		r.Header.Set("X-Request-Id", newRequestID())
+	}
+
+	// Let rules match the client IP
+	s.setClientNetHeaders(r)
+
 	// Pass to mux
 	s.router.ServeHTTP(w, r)
 }
@@ -73,49 +191,198 @@ func (s *Server) AllowHandler(rule string) http.HandlerFunc {
 	}
 }
 
+// DenyHandler Denies requests
+func (s *Server) DenyHandler(rule string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.logger(r, "Deny", rule, "Denying request")
+		s.render(w, r, http.StatusForbidden, pageForbidden, PageData{
+			Reason: "Access to this resource is denied.",
+		})
+	}
+}
+
+// IdentifyHandler Allows requests, identifying the user if they have a valid
+// session permitted by the rule but never asking them to log in
+func (s *Server) IdentifyHandler(rule string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger(r, "Identify", rule, "Identifying request")
+
+		if c, err := r.Cookie(s.config.CookieName); err == nil {
+			email, err := s.auth.ValidateCookie(r, c)
+			switch {
+			case err != nil:
+				logger.WithField("error", err).Debug("Invalid cookie, allowing anonymous request")
+			case !s.auth.ValidateEmail(email, rule):
+				logger.WithField("email", email).Debug("Email not permitted, allowing anonymous request")
+			default:
+				logger.WithField("email", email).Debug("Allowing identified request")
+				w.Header().Set("X-Forwarded-User", email)
+			}
+		}
+
+		w.WriteHeader(200)
+	}
+}
+
 // AuthHandler Authenticates requests
 func (s *Server) AuthHandler(providerName, rule string) http.HandlerFunc {
-	p, _ := config.GetConfiguredProvider(providerName)
+	p, _ := s.config.GetConfiguredProvider(providerName)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Logging setup
 		logger := s.logger(r, "Auth", rule, "Authenticating request")
 
 		// Get auth cookie
-		c, err := r.Cookie(config.CookieName)
+		c, err := r.Cookie(s.config.CookieName)
 		if err != nil {
-			s.authRedirect(logger, w, r, p)
+			s.notAuthenticated(logger, w, r, p, rule)
 			return
 		}
 
 		// Validate cookie
-		email, err := ValidateCookie(r, c)
+		email, err := s.auth.ValidateCookie(r, c)
 		if err != nil {
 			if err.Error() == "Cookie has expired" {
 				logger.Info("Cookie has expired")
-				s.authRedirect(logger, w, r, p)
+				s.notAuthenticated(logger, w, r, p, rule)
 			} else {
 				logger.WithField("error", err).Warn("Invalid cookie")
-				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				s.render(w, r, http.StatusUnauthorized, pageError, PageData{
+					Reason: "Your session is invalid, please clear your cookies and try again.",
+				})
+			}
+			return
+		}
+
+		// Re-authenticate sessions older than the rule allows, keeping the
+		// session for other rules until the new login replaces it, unless
+		// they already have, as the provider reports an old login
+		if !s.sessionFresh(rule, r, email) {
+			if s.auth.reauthenticated(r, rule) {
+				logger.WithField("email", email).Warn("Session older than rule max-auth-age after re-authenticating")
+				http.SetCookie(w, s.auth.ClearReauthCookie(r))
+				s.render(w, r, http.StatusForbidden, pageForbidden, PageData{
+					Reason: "This resource requires a more recent login than was completed.",
+				})
+				return
+			}
+
+			logger.WithField("email", email).Info("Session older than rule max-auth-age, re-authenticating")
+			http.SetCookie(w, s.auth.MakeReauthCookie(r, rule))
+			s.notAuthenticated(logger, w, r, p, rule, oauth2.SetAuthURLParam("prompt", "login"))
+			return
+		}
+
+		// Step up sessions not meeting the rule's acr or amr requirements,
+		// unless they already have, as the provider can't meet them
+		if !s.sessionSatisfies(rule, r, email) {
+			if s.auth.steppedUp(r, rule) {
+				logger.WithField("email", email).Warn("Session doesn't meet rule acr or amr after step up")
+				http.SetCookie(w, s.auth.ClearStepUpCookie(r))
+				s.render(w, r, http.StatusForbidden, pageForbidden, PageData{
+					Reason: "This resource requires a stronger login than was completed.",
+				})
+				return
 			}
+
+			logger.WithField("email", email).Info("Session doesn't meet rule acr or amr, stepping up")
+			http.SetCookie(w, s.auth.MakeStepUpCookie(r, rule))
+			s.notAuthenticated(logger, w, r, p, rule, oauth2.SetAuthURLParam("prompt", "login"))
 			return
 		}
 
 		// Validate user
-		valid := ValidateEmail(email, rule)
+		valid := s.auth.ValidateEmail(email, rule)
 		if !valid {
 			logger.WithField("email", email).Warn("Invalid email")
-			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			s.render(w, r, http.StatusForbidden, pageForbidden, PageData{
+				Reason: fmt.Sprintf("%s is not permitted to access this resource.", email),
+			})
+			return
+		}
+
+		// Validate rule policy
+		if !s.policyAllows(rule, r, email) {
+			logger.WithField("email", email).Warn("Denied by rule policy")
+			s.render(w, r, http.StatusForbidden, pageForbidden, PageData{
+				Reason: fmt.Sprintf("%s is not permitted to access this resource.", email),
+			})
+			return
+		}
+
+		// Consult rule webhook
+		decision, err := s.webhookDecision(rule, r, email)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error":     err,
+				"fail_open": decision.Allow,
+			}).Error("Webhook failed")
+		}
+		if decision != nil && !decision.Allow {
+			logger.WithField("email", email).Warn("Denied by rule webhook")
+			reason := decision.Reason
+			if reason == "" {
+				reason = fmt.Sprintf("%s is not permitted to access this resource.", email)
+			}
+			s.render(w, r, http.StatusForbidden, pageForbidden, PageData{Reason: reason})
 			return
 		}
 
 		// Valid request
 		logger.Debug("Allowing valid request")
+		if decision != nil {
+			for name, value := range decision.Headers {
+				w.Header().Set(name, value)
+			}
+		}
 		w.Header().Set("X-Forwarded-User", email)
 		w.WriteHeader(200)
 	}
 }
 
+// sessionUser returns the user stored in the UserInfo cookie if it's for the
+// user authenticated as email, or a user with only the email otherwise
+func (s *Server) sessionUser(r *http.Request, email string) provider.User {
+	user, err := s.auth.ReadUserCookie(r)
+	if err != nil || user.Email != email {
+		return provider.User{Email: email}
+	}
+	return user
+}
+
+// sessionFresh checks the user authenticated as email last authenticated
+// with the provider within the rule's max-auth-age, if it has one. Sessions
+// without an auth time are never fresh
+func (s *Server) sessionFresh(rule string, r *http.Request, email string) bool {
+	rl, ok := s.config.Rules[rule]
+	if !ok || rl.MaxAuthAge <= 0 {
+		return true
+	}
+
+	authTime := s.sessionUser(r, email).AuthTime
+	return authTime > 0 && time.Since(time.Unix(authTime, 0)) <= time.Duration(rl.MaxAuthAge)*time.Second
+}
+
+// sessionSatisfies checks the user authenticated as email logged in with
+// one of the rule's acr values, if it has any, and all of its amr values
+func (s *Server) sessionSatisfies(rule string, r *http.Request, email string) bool {
+	rl, ok := s.config.Rules[rule]
+	if !ok || (len(rl.ACR) == 0 && len(rl.AMR) == 0) {
+		return true
+	}
+
+	user := s.sessionUser(r, email)
+	if len(rl.ACR) > 0 && !contains(rl.ACR, user.ACR) {
+		return false
+	}
+	for _, method := range rl.AMR {
+		if !contains(user.AMR, method) {
+			return false
+		}
+	}
+	return true
+}
+
 // AuthCallbackHandler Handles auth callback request
 func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -128,54 +395,65 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 			logger.WithFields(logrus.Fields{
 				"error": err,
 			}).Warn("Error validating state")
-			http.Error(w, "Not authorized", 401)
+			s.render(w, r, http.StatusUnauthorized, pageError, PageData{Reason: "Invalid login state."})
 			return
 		}
 
 		// Check for CSRF cookie
-		c, err := FindCSRFCookie(r, state)
+		c, err := s.auth.FindCSRFCookie(r, state)
 		if err != nil {
 			logger.Info("Missing csrf cookie")
-			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			s.render(w, r, http.StatusUnauthorized, pageError, PageData{
+				Reason: "Your login has expired or was started in another browser, please try again.",
+			})
 			return
 		}
 
 		// Validate CSRF cookie against state
-		valid, providerName, redirect, err := ValidateCSRFCookie(c, state)
+		valid, providerName, redirect, err := s.auth.ValidateCSRFCookie(c, state)
 		if !valid {
-			logger.WithFields(logrus.Fields{
+			audit(logger, "invalid_state", logrus.Fields{
 				"error":       err,
 				"csrf_cookie": c,
-			}).Warn("Error validating csrf cookie")
-			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			}, "Error validating csrf cookie")
+			s.render(w, r, http.StatusUnauthorized, pageError, PageData{Reason: "Invalid login state."})
 			return
 		}
 
 		// Get provider
-		p, err := config.GetConfiguredProvider(providerName)
+		p, err := s.config.GetConfiguredProvider(providerName)
 		if err != nil {
 			logger.WithFields(logrus.Fields{
 				"error":       err,
 				"csrf_cookie": c,
 				"provider":    providerName,
 			}).Warn("Invalid provider in csrf cookie")
-			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			s.render(w, r, http.StatusUnauthorized, pageError, PageData{Reason: "Invalid login state."})
+			return
+		}
+
+		// Only return the user to hosts the login could have started from
+		if !s.auth.validRedirect(r, redirect) {
+			audit(logger, "invalid_redirect", logrus.Fields{"redirect": redirect}, "Invalid redirect in csrf cookie")
+			s.render(w, r, http.StatusBadRequest, pageError, PageData{Reason: "Invalid redirect."})
 			return
 		}
 
 		// Clear CSRF cookie
-		http.SetCookie(w, ClearCSRFCookie(r, c))
+		http.SetCookie(w, s.auth.ClearCSRFCookie(r, c))
 
 		redirectURI := &url.URL{
 			Scheme: r.Header.Get("X-Forwarded-Proto"),
 			Host:   r.Host,
-			Path:   config.Path,
+			Path:   s.config.Path,
 		}
 
 		user, err := p.GetUserFromCode(r.URL.Query().Get("code"), redirectURI.String())
 		if err != nil {
 			logger.Errorf("GetUserFromCode: %v", err)
-			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			s.render(w, r, http.StatusUnauthorized, pageError, PageData{
+				Reason: "Unable to retrieve your details from the identity provider.",
+			})
 			return
 		}
 
@@ -184,13 +462,20 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 		logger.Debug("User FirstName--------------------------------------------------->" + user.FirstName)
 		logger.Debug("User LastName--------------------------------------------------->" + user.LastName)
 		// Generate cookie
-		http.SetCookie(w, MakeCookie(r, user.Email))
-		http.SetCookie(w, MakeCookie(r, user.ID))
+		http.SetCookie(w, s.auth.MakeCookie(r, user.Email))
+		http.SetCookie(w, s.auth.MakeCookie(r, user.ID))
+
+		// Providers that don't report when the user authenticated were sent
+		// max_age or prompt=login by rules needing a recent login, so the
+		// time of this callback is used instead
+		if user.AuthTime == 0 {
+			user.AuthTime = time.Now().Unix()
+		}
 
-		cookie, err := MakeUserCookie(r, fmt.Sprintf("%s|%s|%s", user.Email, user.FirstName, user.LastName))
+		cookie, err := s.auth.MakeUserInfoCookie(r, user)
 		if err != nil {
-			logger.Errorf("MakeUserCookie: %v", err)
-			http.Error(w, "Not authorized", http.StatusInternalServerError)
+			logger.Errorf("MakeUserInfoCookie: %v", err)
+			s.render(w, r, http.StatusInternalServerError, pageError, PageData{})
 			return
 		}
 		http.SetCookie(w, cookie)
@@ -205,63 +490,297 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 	}
 }
 
-// LogoutHandler logs a user out
+// LogoutHandler logs a user out, returning them to rd if given and valid, or
+// to the configured logout redirect
 func (s *Server) LogoutHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Clear cookie
-		http.SetCookie(w, ClearCookie(r))
+		http.SetCookie(w, s.auth.ClearCookie(r))
 
 		logger := s.logger(r, "Logout", "default", "Handling logout")
 		logger.Info("Logged out user")
 
-		if config.LogoutRedirect != "" {
-			http.Redirect(w, r, config.LogoutRedirect, http.StatusTemporaryRedirect)
+		redirect := s.config.LogoutRedirect
+		if rd := r.URL.Query().Get("rd"); rd != "" {
+			if s.auth.validRedirect(r, rd) {
+				redirect = rd
+			} else {
+				audit(logger, "invalid_redirect", logrus.Fields{"redirect": rd}, "Invalid redirect in logout")
+			}
+		}
+
+		if redirect != "" {
+			http.Redirect(w, r, redirect, http.StatusTemporaryRedirect)
 		} else {
-			http.Error(w, "You have been logged out", 401)
+			// Not a 2xx, otherwise traefik would forward the request
+			s.render(w, r, http.StatusUnauthorized, pageLogout, PageData{})
+		}
+	}
+}
+
+// ChooseHandler lists the providers allowed by a rule and starts the login
+// flow with the one chosen
+func (s *Server) ChooseHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger(r, "Choose", "default", "Handling provider choice")
+
+		q := r.URL.Query()
+		rule := q.Get("rule")
+		redirect := q.Get("rd")
+		if !s.auth.validRedirect(r, redirect) {
+			audit(logger, "invalid_redirect", logrus.Fields{"redirect": redirect}, "Invalid redirect in provider choice")
+			s.render(w, r, http.StatusBadRequest, pageError, PageData{Reason: "Invalid redirect."})
+			return
+		}
+
+		names := s.config.ruleProviders(rule)
+		name := q.Get("provider")
+		if name == "" {
+			// Not a 2xx, otherwise traefik would forward the request
+			data := PageData{}
+			for _, name := range names {
+				q.Set("provider", name)
+				data.Providers = append(data.Providers, ProviderChoice{
+					Name: name,
+					URL:  s.config.Path + "/choose?" + q.Encode(),
+				})
+			}
+			s.render(w, r, http.StatusUnauthorized, pageChoose, data)
+			return
+		}
+
+		p, err := s.config.GetConfiguredProvider(name)
+		if err != nil || !contains(names, name) {
+			logger.WithField("provider", name).Warn("Invalid provider choice")
+			s.render(w, r, http.StatusBadRequest, pageError, PageData{Reason: "Invalid provider."})
+			return
+		}
+
+		// Remember the choice for next time
+		http.SetCookie(w, s.auth.MakeProviderCookie(r, name))
+
+		// Step up and re-authentication ask for credentials again, as they
+		// do when the provider is remembered, so the provider's existing
+		// session isn't reused
+		opts := s.config.loginOptions(rule)
+		if s.auth.steppedUp(r, rule) || s.auth.reauthenticated(r, rule) {
+			opts = append(opts, oauth2.SetAuthURLParam("prompt", "login"))
+		}
+
+		loginURL, ok := s.startLogin(logger, w, r, p, redirect, opts...)
+		if !ok {
+			return
+		}
+		http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
+
+		logger.WithFields(logrus.Fields{
+			"provider":  name,
+			"login_url": loginURL,
+		}).Debug("Redirected to chosen provider login url")
+	}
+}
+
+// LoginHandler starts the login flow on demand, with the given provider or
+// one of those allowed by the given rule, and the rule's login requirements,
+// returning the user to rd once logged in
+func (s *Server) LoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger(r, "Login", "default", "Handling login")
+
+		q := r.URL.Query()
+		rule := q.Get("rule")
+		if rule == "" {
+			rule = "default"
+		}
+		redirect := q.Get("rd")
+		if redirect == "" {
+			redirect = redirectBase(r) + "/"
+		}
+		if !s.auth.validRedirect(r, redirect) {
+			audit(logger, "invalid_redirect", logrus.Fields{"redirect": redirect}, "Invalid redirect in login")
+			s.render(w, r, http.StatusBadRequest, pageError, PageData{Reason: "Invalid redirect."})
+			return
+		}
+
+		names := s.config.ruleProviders(rule)
+		if name := q.Get("provider"); name != "" {
+			if !contains(names, name) {
+				logger.WithField("provider", name).Warn("Invalid provider for login")
+				s.render(w, r, http.StatusBadRequest, pageError, PageData{Reason: "Invalid provider."})
+				return
+			}
+			names = []string{name}
+		}
+
+		// Let the user pick a provider if the rule allows several and they
+		// haven't chosen one before
+		p := s.auth.rememberedProvider(r, names)
+		if p == nil && len(names) > 1 {
+			choose := url.Values{"rule": {rule}, "rd": {redirect}}
+			http.Redirect(w, r, s.config.Path+"/choose?"+choose.Encode(), http.StatusTemporaryRedirect)
+			return
+		}
+		if p == nil {
+			var err error
+			if p, err = s.config.GetConfiguredProvider(names[0]); err != nil {
+				logger.WithField("provider", names[0]).Warn("Invalid provider for login")
+				s.render(w, r, http.StatusBadRequest, pageError, PageData{Reason: "Invalid provider."})
+				return
+			}
+		}
+
+		loginURL, ok := s.startLogin(logger, w, r, p, redirect, s.config.loginOptions(rule)...)
+		if !ok {
+			return
+		}
+		http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
+
+		logger.WithField("login_url", loginURL).Debug("Redirected to provider login url")
+	}
+}
+
+// Respond to a request without a valid session, API requests receive a 401
+// so clients aren't sent on a cross-origin redirect they can't follow
+func (s *Server) notAuthenticated(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, p provider.Provider, rule string, opts ...oauth2.AuthCodeOption) {
+	api := isAPIRequest(r, s.config.unauthenticatedResponse(rule))
+	opts = append(s.config.loginOptions(rule), opts...)
+
+	// Let the user pick a provider if the rule allows several and they
+	// haven't chosen one before
+	if names := s.config.ruleProviders(rule); len(names) > 1 {
+		if p = s.auth.rememberedProvider(r, names); p == nil {
+			chooseURL := s.auth.chooserUrl(r, rule)
+			if api {
+				writeChallenge(w, r, chooseURL)
+			} else {
+				http.Redirect(w, r, chooseURL, http.StatusTemporaryRedirect)
+			}
+			logger.WithField("choose_url", chooseURL).Debug("Sent user to provider chooser")
+			return
 		}
 	}
+
+	if api {
+		s.authChallenge(logger, w, r, p, opts...)
+	} else {
+		s.authRedirect(logger, w, r, p, opts...)
+	}
 }
 
-func (s *Server) authRedirect(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, p provider.Provider) {
+func (s *Server) authRedirect(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, p provider.Provider, opts ...oauth2.AuthCodeOption) {
+	loginURL, ok := s.startLogin(logger, w, r, p, returnUrl(r), opts...)
+	if !ok {
+		return
+	}
+
+	if s.config.LoginPage {
+		// Not a 2xx, otherwise traefik would forward the request
+		s.render(w, r, http.StatusUnauthorized, pageLogin, PageData{LoginURL: loginURL})
+		logger.WithField("login_url", loginURL).Debug("Rendered login page")
+		return
+	}
+
+	// Forward them on
+	http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
+
+	logger.WithField("login_url", loginURL).Debug("Redirected to provider login url")
+}
+
+func (s *Server) authChallenge(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, p provider.Provider, opts ...oauth2.AuthCodeOption) {
+	loginURL, ok := s.startLogin(logger, w, r, p, returnUrl(r), opts...)
+	if !ok {
+		return
+	}
+
+	writeChallenge(w, r, loginURL)
+
+	logger.WithField("login_url", loginURL).Debug("Returned login url to API request")
+}
+
+// writeChallenge writes a 401 pointing the client at the given login url
+func writeChallenge(w http.ResponseWriter, r *http.Request, loginURL string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, login_url=%q", r.Header.Get("X-Forwarded-Host"), loginURL))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(struct {
+		Error    string `json:"error"`
+		LoginURL string `json:"login_url"`
+	}{"unauthorized", loginURL})
+}
+
+// Set the CSRF cookie and build the provider login url, with any extra
+// parameters given by opts, the user will be returned to redirect once
+// logged in
+func (s *Server) startLogin(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, p provider.Provider, redirect string, opts ...oauth2.AuthCodeOption) (string, bool) {
 	// Error indicates no cookie, generate nonce
 	err, nonce := Nonce()
 	if err != nil {
 		logger.WithField("error", err).Error("Error generating nonce")
-		http.Error(w, "Service unavailable", 503)
-		return
+		s.render(w, r, http.StatusServiceUnavailable, pageError, PageData{})
+		return "", false
 	}
 
 	// Set the CSRF cookie
-	csrf := MakeCSRFCookie(r, nonce)
+	csrf := s.auth.MakeCSRFCookie(r, nonce)
 	http.SetCookie(w, csrf)
-	logger.Debug("Set CSRF cookie and redirecting to OIDC login")
+	logger.WithField("csrf_cookie", csrf).Debug("Set CSRF cookie")
 
-	if !config.InsecureCookie && r.Header.Get("X-Forwarded-Proto") != "https" {
+	if !s.config.InsecureCookie && r.Header.Get("X-Forwarded-Proto") != "https" {
 		logger.Warn("You are using \"secure\" cookies for a request that was not " +
 			"received via https. You should either redirect to https or pass the " +
 			"\"insecure-cookie\" config option to permit cookies via http.")
 	}
 
-	// Forward them on
-	loginURL := p.GetLoginURL(redirectUri(r), MakeState(r, p, nonce))
-	http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
+	return p.GetLoginURL(s.auth.redirectUri(r), s.auth.MakeState(redirect, p, nonce), opts...), true
+}
 
-	logger.WithFields(logrus.Fields{
-		"csrf_cookie": csrf,
-		"login_url":   loginURL,
-	}).Debug("Set CSRF cookie and redirected to provider login url")
+// isAPIRequest determines if the request was made by a script rather than
+// a browser navigation, according to the given unauthenticated response mode
+func isAPIRequest(r *http.Request, mode string) bool {
+	switch mode {
+	case "redirect":
+		return false
+	case "unauthorized":
+		return true
+	}
+
+	if strings.EqualFold(r.Header.Get("X-Requested-With"), "XMLHttpRequest") {
+		return true
+	}
+
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" && !strings.HasSuffix(mode, "navigate") {
+		return true
+	}
+
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// render writes the named page, logging any failure to render it
+func (s *Server) render(w http.ResponseWriter, r *http.Request, status int, name string, data PageData) {
+	if err := s.pages.Render(w, r, status, name, data); err != nil {
+		s.log.WithField("error", err).Error("Error rendering page")
+	}
+}
+
+// audit logs a rejected attempt to tamper with the login flow or send users
+// to another host, with an audit field naming the event so they can be
+// collected separately from other warnings
+func audit(logger *logrus.Entry, event string, fields logrus.Fields, msg string) {
+	logger.WithFields(fields).WithField("audit", event).Warn(msg)
 }
 
 func (s *Server) logger(r *http.Request, handler, rule, msg string) *logrus.Entry {
 	// Create logger
-	logger := log.WithFields(logrus.Fields{
-		"handler":   handler,
-		"rule":      rule,
-		"method":    r.Header.Get("X-Forwarded-Method"),
-		"proto":     r.Header.Get("X-Forwarded-Proto"),
-		"host":      r.Header.Get("X-Forwarded-Host"),
-		"uri":       r.Header.Get("X-Forwarded-Uri"),
-		"source_ip": r.Header.Get("X-Forwarded-For"),
+	logger := s.log.WithFields(logrus.Fields{
+		"handler":    handler,
+		"rule":       rule,
+		"method":     r.Header.Get("X-Forwarded-Method"),
+		"proto":      r.Header.Get("X-Forwarded-Proto"),
+		"host":       r.Header.Get("X-Forwarded-Host"),
+		"uri":        r.Header.Get("X-Forwarded-Uri"),
+		"source_ip":  r.Header.Get("X-Forwarded-For"),
+		"request_id": r.Header.Get("X-Request-Id"),
 	})
 
 	// Log request
@@ -3,12 +3,16 @@ package tfa
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/containous/traefik/v2/pkg/rules"
 	"github.com/rajasoun/traefik-forward-auth/internal/provider"
 	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"golang.org/x/oauth2"
 )
 
@@ -24,6 +28,7 @@ func setupTestServer(t *testing.T) func(t *testing.T) {
 	reqSrv.Header.Set("X-Forwarded-Host", "host")
 	reqSrv.Header.Set("X-Forwarded-Uri", "uri")
 	reqSrv.Header.Set("X-Forwarded-For", "source_ip")
+	reqSrv.Header.Set("X-Request-Id", "request_id")
 	reqSrv.AddCookie(&http.Cookie{Name: "test_cookie", Value: "test_cookie"})
 	router, _ = rules.NewRouter()
 	return func(t *testing.T) {}
@@ -56,21 +61,22 @@ func TestServer_logger(t *testing.T) {
 				msg:     "msg",
 			},
 			want: logrus.StandardLogger().WithFields(logrus.Fields{
-				"handler":   "handler",
-				"rule":      "rule",
-				"method":    "method",
-				"proto":     "proto",
-				"host":      "host",
-				"uri":       "uri",
-				"source_ip": "source_ip",
+				"handler":    "handler",
+				"rule":       "rule",
+				"method":     "method",
+				"proto":      "proto",
+				"host":       "host",
+				"uri":        "uri",
+				"source_ip":  "source_ip",
+				"request_id": "request_id",
 			}),
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			log = logrus.StandardLogger()
 			s := &Server{
 				router: tt.fields.router,
+				log:    logrus.StandardLogger(),
 			}
 			if got := s.logger(tt.args.r, tt.args.handler, tt.args.rule, tt.args.msg); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Server.logger() = \n%+v, want \n%+v", got, tt.want)
@@ -137,15 +143,41 @@ func TestNewServer(t *testing.T) {
 		},
 	}
 	for _, tt := range tests {
-		config = tt.fields.config
 		t.Run(tt.name, func(t *testing.T) {
-			if got := NewServer(); got == nil {
-				t.Errorf("NewServer() = %v, want %v", got, tt.want)
+			if got, err := NewServer(tt.fields.config, nil); err != nil || got == nil {
+				t.Errorf("NewServer() = %v, %v, want %v", got, err, tt.want)
 			}
 		})
 	}
 }
 
+func TestNewServer_independent(t *testing.T) {
+	allow, err := NewServer(&Config{DefaultAction: "allow"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logout, err := NewServer(&Config{
+		DefaultAction:  "allow",
+		Path:           "/_oauth",
+		LogoutRedirect: "https://example.com/bye",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	allow.RootHandler(w, newForwardedRequest("GET", "example.com", "/_oauth/logout"))
+	if w.Code != http.StatusOK {
+		t.Errorf("RootHandler() code = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	w = httptest.NewRecorder()
+	logout.RootHandler(w, newForwardedRequest("GET", "example.com", "/_oauth/logout"))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("RootHandler() code = %v, want %v", w.Code, http.StatusTemporaryRedirect)
+	}
+}
+
 func TestServer_RootHandler(t *testing.T) {
 	setupTestServer(t)
 	type fields struct {
@@ -230,9 +262,995 @@ func TestServer_authRedirect(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Server{
 				router: tt.fields.router,
+				config: tt.fields.config,
+				auth:   NewAuth(tt.fields.config),
+				log:    logrus.StandardLogger(),
 			}
-			config = tt.fields.config
 			s.authRedirect(tt.args.logger, tt.args.w, tt.args.r, tt.args.p)
 		})
 	}
 }
+
+func TestServer_authChallenge(t *testing.T) {
+	setupTestServer(t)
+	config := &Config{
+		CSRFCookieName: "_forward_auth_csrf",
+	}
+	p := &provider.OIDC{
+		OAuthProvider: provider.OAuthProvider{
+			Config: &oauth2.Config{},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	s := &Server{router: router, config: config, auth: NewAuth(config), log: logrus.StandardLogger()}
+	s.authChallenge(logrus.NewEntry(logrus.StandardLogger()), w, reqSrv, p)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Server.authChallenge() code = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Server.authChallenge() content type = %v, want application/json", ct)
+	}
+	if h := w.Header().Get("WWW-Authenticate"); !strings.Contains(h, "login_url=") {
+		t.Errorf("Server.authChallenge() WWW-Authenticate = %v, want login_url", h)
+	}
+	if !strings.Contains(w.Body.String(), `"login_url":`) {
+		t.Errorf("Server.authChallenge() body = %v, want login_url", w.Body.String())
+	}
+	if len(w.Result().Cookies()) != 1 {
+		t.Errorf("Server.authChallenge() should set the csrf cookie")
+	}
+}
+
+func Test_isAPIRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		headers map[string]string
+		want    bool
+	}{
+		{
+			name:    "test browser navigation",
+			mode:    "auto",
+			headers: map[string]string{"Accept": "text/html,application/xhtml+xml", "Sec-Fetch-Mode": "navigate"},
+			want:    false,
+		},
+		{
+			name:    "test json accept",
+			mode:    "auto",
+			headers: map[string]string{"Accept": "application/json"},
+			want:    true,
+		},
+		{
+			name:    "test xhr",
+			mode:    "auto",
+			headers: map[string]string{"X-Requested-With": "XMLHttpRequest"},
+			want:    true,
+		},
+		{
+			name:    "test fetch",
+			mode:    "auto",
+			headers: map[string]string{"Sec-Fetch-Mode": "cors"},
+			want:    true,
+		},
+		{
+			name:    "test redirect mode",
+			mode:    "redirect",
+			headers: map[string]string{"Accept": "application/json"},
+			want:    false,
+		},
+		{
+			name:    "test unauthorized mode",
+			mode:    "unauthorized",
+			headers: map[string]string{},
+			want:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://example.com", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := isAPIRequest(r, tt.mode); got != tt.want {
+				t.Errorf("isAPIRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func setupChooserTest(t *testing.T) *Server {
+	config := &Config{
+		Path:                 "/_oauth",
+		CSRFCookieName:       "_forward_auth_csrf",
+		ProviderCookieName:   "_forward_auth_provider",
+		DefaultProvider:      "oidc",
+		AllowedRedirectHosts: []string{"partner.example.org"},
+		Rules: map[string]*Rule{
+			"multi": {
+				Action:    "auth",
+				Rule:      "PathPrefix(`/multi`)",
+				Provider:  "oidc",
+				Providers: []string{"oidc", "other"},
+			},
+		},
+		Providers: provider.Providers{
+			OIDC: provider.OIDC{
+				OAuthProvider: provider.OAuthProvider{
+					Config: &oauth2.Config{},
+				},
+			},
+		},
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newForwardedRequest(method, host, uri string) *http.Request {
+	r := httptest.NewRequest("GET", "http://tfa", nil)
+	r.Header.Set("X-Forwarded-Method", method)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", host)
+	r.Header.Set("X-Forwarded-Uri", uri)
+	return r
+}
+
+func TestServer_ChooseHandler_namedProviders(t *testing.T) {
+	corp, partner := newMockIssuer(), newMockIssuer()
+	defer corp.Close()
+	defer partner.Close()
+	config, err := NewConfig([]string{
+		"--secret=secret",
+		"--cookie-hash-key=AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+		"--cookie-block-key=R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+		"--default-provider=oidc",
+		"--providers.oidc.issuer-url=" + corp.URL,
+		"--providers.oidc.client-id=corp-client",
+		"--providers.oidc.client-secret=corp-secret",
+		"--provider.partner.issuer-url=" + partner.URL,
+		"--provider.partner.client-id=partner-client",
+		"--provider.partner.client-secret=partner-secret",
+		"--rule.app.rule=PathPrefix(`/app`)",
+		"--rule.app.providers=oidc,partner",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Check(); err != nil {
+		t.Fatalf("Config.Check() = %v", err)
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.RootHandler(w, newForwardedRequest("GET", "example.com", "/app"))
+	if w.Code != http.StatusTemporaryRedirect || !strings.Contains(w.Header().Get("Location"), "/_oauth/choose?") {
+		t.Fatalf("RootHandler() = %v %v, want redirect to chooser", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	s.RootHandler(w, newForwardedRequest("GET", "example.com", "/_oauth/choose?rule=app&rd=https%3A%2F%2Fexample.com%2Fapp"))
+	for _, name := range []string{"provider=oidc", "provider=partner"} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("ChooseHandler() body = %v, want %v", w.Body.String(), name)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	s.RootHandler(w, newForwardedRequest("GET", "example.com", "/_oauth/choose?rule=app&provider=partner&rd=https%3A%2F%2Fexample.com%2Fapp"))
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loc.Scheme + "://" + loc.Host + loc.Path; got != partner.URL+"/auth" {
+		t.Errorf("ChooseHandler() location = %v, want %v", got, partner.URL+"/auth")
+	}
+	if got := loc.Query().Get("client_id"); got != "partner-client" {
+		t.Errorf("ChooseHandler() client_id = %v, want partner-client", got)
+	}
+	if got := loc.Query().Get("state"); !strings.Contains(got, ":partner:") {
+		t.Errorf("ChooseHandler() state = %v, want partner provider", got)
+	}
+}
+
+func TestServer_ChooseHandler_freshLogin(t *testing.T) {
+	corp, partner := newMockIssuer(), newMockIssuer()
+	defer corp.Close()
+	defer partner.Close()
+	config, err := NewConfig([]string{
+		"--secret=secret",
+		"--cookie-hash-key=AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+		"--cookie-block-key=R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+		"--user-info-format=json",
+		"--default-provider=oidc",
+		"--providers.oidc.issuer-url=" + corp.URL,
+		"--providers.oidc.client-id=corp-client",
+		"--providers.oidc.client-secret=corp-secret",
+		"--provider.partner.issuer-url=" + partner.URL,
+		"--provider.partner.client-id=partner-client",
+		"--provider.partner.client-secret=partner-secret",
+		"--rule.payroll.rule=PathPrefix(`/payroll`)",
+		"--rule.payroll.providers=oidc,partner",
+		"--rule.payroll.max-auth-age=900",
+		"--rule.payroll.acr=urn:example:mfa",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Check(); err != nil {
+		t.Fatalf("Config.Check() = %v", err)
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newForwardedRequest("GET", "example.com", "/payroll")
+	tests := []struct {
+		name       string
+		cookie     *http.Cookie
+		wantPrompt string
+	}{
+		{
+			name: "test first login",
+		},
+		{
+			name:       "test step up",
+			cookie:     s.auth.MakeStepUpCookie(r, "payroll"),
+			wantPrompt: "login",
+		},
+		{
+			name:       "test re-authentication",
+			cookie:     s.auth.MakeReauthCookie(r, "payroll"),
+			wantPrompt: "login",
+		},
+		{
+			name:   "test step up for another rule",
+			cookie: s.auth.MakeStepUpCookie(r, "admin"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newForwardedRequest("GET", "example.com", "/_oauth/choose?rule=payroll&provider=partner&rd=https%3A%2F%2Fexample.com%2Fpayroll")
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			w := httptest.NewRecorder()
+			s.RootHandler(w, req)
+
+			loc, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := loc.Query().Get("prompt"); got != tt.wantPrompt {
+				t.Errorf("ChooseHandler() prompt = %q, want %q", got, tt.wantPrompt)
+			}
+			if got := loc.Query().Get("max_age"); got != "900" {
+				t.Errorf("ChooseHandler() max_age = %q, want 900", got)
+			}
+		})
+	}
+}
+
+func TestServer_notAuthenticated_chooser(t *testing.T) {
+	tests := []struct {
+		name         string
+		cookie       *http.Cookie
+		wantLocation string
+	}{
+		{
+			name:         "test no remembered provider",
+			wantLocation: "https://example.com/_oauth/choose?rd=https%3A%2F%2Fexample.com%2Fmulti&rule=multi",
+		},
+		{
+			name:         "test remembered provider",
+			cookie:       &http.Cookie{Name: "_forward_auth_provider", Value: "oidc"},
+			wantLocation: "/?client_id=",
+		},
+		{
+			name:         "test remembered provider not allowed",
+			cookie:       &http.Cookie{Name: "_forward_auth_provider", Value: "unknown"},
+			wantLocation: "https://example.com/_oauth/choose?",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupChooserTest(t)
+			r := newForwardedRequest("GET", "example.com", "/multi")
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+			w := httptest.NewRecorder()
+			s.RootHandler(w, r)
+
+			if w.Code != http.StatusTemporaryRedirect {
+				t.Errorf("RootHandler() code = %v, want %v", w.Code, http.StatusTemporaryRedirect)
+			}
+			if got := w.Header().Get("Location"); !strings.HasPrefix(got, tt.wantLocation) {
+				t.Errorf("RootHandler() location = %v, want %v", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestServer_ChooseHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		uri        string
+		wantCode   int
+		wantBody   string
+		wantCookie string
+	}{
+		{
+			name:     "test list providers",
+			uri:      "/_oauth/choose?rule=multi&rd=https%3A%2F%2Fexample.com%2Fmulti",
+			wantCode: http.StatusUnauthorized,
+			wantBody: "/_oauth/choose?provider=other",
+		},
+		{
+			name:       "test choose provider",
+			uri:        "/_oauth/choose?rule=multi&provider=oidc&rd=https%3A%2F%2Fexample.com%2Fmulti",
+			wantCode:   http.StatusTemporaryRedirect,
+			wantCookie: "_forward_auth_provider",
+		},
+		{
+			name:     "test provider not allowed",
+			uri:      "/_oauth/choose?rule=multi&provider=google&rd=https%3A%2F%2Fexample.com%2Fmulti",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "test invalid redirect",
+			uri:      "/_oauth/choose?rule=multi&provider=oidc&rd=https%3A%2F%2Fevil.com%2F",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupChooserTest(t)
+			w := httptest.NewRecorder()
+			s.RootHandler(w, newForwardedRequest("GET", "example.com", tt.uri))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("ChooseHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("ChooseHandler() body = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+			if tt.wantCookie != "" {
+				found := false
+				for _, c := range w.Result().Cookies() {
+					found = found || (c.Name == tt.wantCookie && c.Value == "oidc")
+				}
+				if !found {
+					t.Errorf("ChooseHandler() should set %v cookie", tt.wantCookie)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_LoginHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		uri          string
+		wantCode     int
+		wantLocation string
+		wantRedirect string
+	}{
+		{
+			name:         "test login",
+			uri:          "/_oauth/login?rd=https%3A%2F%2Fexample.com%2Fpage",
+			wantCode:     http.StatusTemporaryRedirect,
+			wantLocation: "/_oauth/?client_id=",
+			wantRedirect: "https://example.com/page",
+		},
+		{
+			name:         "test login without redirect",
+			uri:          "/_oauth/login",
+			wantCode:     http.StatusTemporaryRedirect,
+			wantLocation: "/_oauth/?client_id=",
+			wantRedirect: "https://example.com/",
+		},
+		{
+			name:         "test login to allowed host",
+			uri:          "/_oauth/login?rd=https%3A%2F%2Fpartner.example.org%2F",
+			wantCode:     http.StatusTemporaryRedirect,
+			wantLocation: "/_oauth/?client_id=",
+			wantRedirect: "https://partner.example.org/",
+		},
+		{
+			name:         "test chosen provider",
+			uri:          "/_oauth/login?rule=multi&provider=oidc&rd=https%3A%2F%2Fexample.com%2Fmulti",
+			wantCode:     http.StatusTemporaryRedirect,
+			wantLocation: "/_oauth/?client_id=",
+			wantRedirect: "https://example.com/multi",
+		},
+		{
+			name:     "test provider not allowed",
+			uri:      "/_oauth/login?rule=multi&provider=google&rd=https%3A%2F%2Fexample.com%2Fmulti",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:         "test rule with multiple providers",
+			uri:          "/_oauth/login?rule=multi&rd=https%3A%2F%2Fexample.com%2Fmulti",
+			wantCode:     http.StatusTemporaryRedirect,
+			wantLocation: "/_oauth/choose?rd=https%3A%2F%2Fexample.com%2Fmulti&rule=multi",
+		},
+		{
+			name:     "test invalid redirect",
+			uri:      "/_oauth/login?rd=https%3A%2F%2Fevil.com%2F",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupChooserTest(t)
+			w := httptest.NewRecorder()
+			s.RootHandler(w, newForwardedRequest("GET", "example.com", tt.uri))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("LoginHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+			loc := w.Header().Get("Location")
+			if !strings.HasPrefix(loc, tt.wantLocation) {
+				t.Errorf("LoginHandler() location = %v, want %v", loc, tt.wantLocation)
+			}
+			if tt.wantRedirect != "" {
+				u, err := url.Parse(loc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if state := u.Query().Get("state"); !strings.Contains(state, ":"+tt.wantRedirect+":") {
+					t.Errorf("LoginHandler() state = %v, want redirect %v", state, tt.wantRedirect)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_AuthCallbackHandler_state(t *testing.T) {
+	tests := []struct {
+		name      string
+		redirect  string
+		tamper    func(state string) string
+		wantCode  int
+		wantBody  string
+		wantAudit string
+	}{
+		{
+			name:     "test redirect to requested host",
+			redirect: "https://example.com/page",
+			wantCode: http.StatusUnauthorized,
+			wantBody: "Unable to retrieve your details",
+		},
+		{
+			name:     "test redirect to allowed host",
+			redirect: "https://partner.example.org/",
+			wantCode: http.StatusUnauthorized,
+			wantBody: "Unable to retrieve your details",
+		},
+		{
+			name:      "test redirect to other host",
+			redirect:  "https://evil.com/",
+			wantCode:  http.StatusBadRequest,
+			wantBody:  "Invalid redirect.",
+			wantAudit: "invalid_redirect",
+		},
+		{
+			name:     "test tampered redirect",
+			redirect: "https://example.com/page",
+			tamper: func(state string) string {
+				return strings.Replace(state, "example.com", "evil.com", 1)
+			},
+			wantCode:  http.StatusUnauthorized,
+			wantBody:  "Invalid login state.",
+			wantAudit: "invalid_state",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupChooserTest(t)
+			logger, hook := test.NewNullLogger()
+			s.log = logger
+			p, err := s.config.GetConfiguredProvider("oidc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonce := "12345678901234567890123456789012"
+			state := s.auth.MakeState(tt.redirect, p, nonce)
+			if tt.tamper != nil {
+				state = tt.tamper(state)
+			}
+
+			r := newForwardedRequest("GET", "example.com", "/_oauth?state="+url.QueryEscape(state)+"&code=abc")
+			r.AddCookie(s.auth.MakeCSRFCookie(r, nonce))
+			w := httptest.NewRecorder()
+			s.RootHandler(w, r)
+
+			// Valid states fail later, exchanging the code
+			if w.Code != tt.wantCode {
+				t.Errorf("AuthCallbackHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("AuthCallbackHandler() body = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+			if got := auditEvent(hook); got != tt.wantAudit {
+				t.Errorf("AuthCallbackHandler() audit = %q, want %q", got, tt.wantAudit)
+			}
+		})
+	}
+}
+
+func TestServer_LogoutHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		uri            string
+		logoutRedirect string
+		wantCode       int
+		wantLocation   string
+		wantAudit      string
+	}{
+		{
+			name:     "test logout page",
+			uri:      "/_oauth/logout",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:           "test logout redirect",
+			uri:            "/_oauth/logout",
+			logoutRedirect: "https://idp.example.net/logout",
+			wantCode:       http.StatusTemporaryRedirect,
+			wantLocation:   "https://idp.example.net/logout",
+		},
+		{
+			name:           "test valid rd",
+			uri:            "/_oauth/logout?rd=https%3A%2F%2Fpartner.example.org%2Fbye",
+			logoutRedirect: "https://idp.example.net/logout",
+			wantCode:       http.StatusTemporaryRedirect,
+			wantLocation:   "https://partner.example.org/bye",
+		},
+		{
+			name:           "test invalid rd",
+			uri:            "/_oauth/logout?rd=https%3A%2F%2Fevil.com%2F",
+			logoutRedirect: "https://idp.example.net/logout",
+			wantCode:       http.StatusTemporaryRedirect,
+			wantLocation:   "https://idp.example.net/logout",
+			wantAudit:      "invalid_redirect",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setupChooserTest(t)
+			s.config.LogoutRedirect = tt.logoutRedirect
+			logger, hook := test.NewNullLogger()
+			s.log = logger
+
+			w := httptest.NewRecorder()
+			s.RootHandler(w, newForwardedRequest("GET", "example.com", tt.uri))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("LogoutHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("LogoutHandler() location = %v, want %v", got, tt.wantLocation)
+			}
+			if got := auditEvent(hook); got != tt.wantAudit {
+				t.Errorf("LogoutHandler() audit = %q, want %q", got, tt.wantAudit)
+			}
+		})
+	}
+}
+
+// auditEvent returns the audit event logged to hook, if any
+func auditEvent(hook *test.Hook) string {
+	for _, entry := range hook.AllEntries() {
+		if event, ok := entry.Data["audit"].(string); ok {
+			return event
+		}
+	}
+	return ""
+}
+
+func TestServer_IdentifyHandler(t *testing.T) {
+	config := &Config{
+		Path:            "/_oauth",
+		Secret:          []byte("secret"),
+		Lifetime:        time.Hour,
+		CookieName:      "_forward_auth",
+		DefaultAction:   "auth",
+		DefaultProvider: "oidc",
+		Rules: map[string]*Rule{
+			"home": {
+				Action:    "identify",
+				Rule:      "PathPrefix(`/home`)",
+				Provider:  "oidc",
+				Whitelist: []string{"test@example.com"},
+			},
+		},
+		Providers: provider.Providers{
+			OIDC: provider.OIDC{
+				OAuthProvider: provider.OAuthProvider{
+					Config: &oauth2.Config{},
+				},
+			},
+		},
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		cookie   func(r *http.Request) *http.Cookie
+		wantUser string
+	}{
+		{
+			name: "test no session",
+		},
+		{
+			name:     "test valid session",
+			cookie:   func(r *http.Request) *http.Cookie { return s.auth.MakeCookie(r, "test@example.com") },
+			wantUser: "test@example.com",
+		},
+		{
+			name:   "test email not permitted",
+			cookie: func(r *http.Request) *http.Cookie { return s.auth.MakeCookie(r, "other@example.com") },
+		},
+		{
+			name:   "test invalid session",
+			cookie: func(r *http.Request) *http.Cookie { return &http.Cookie{Name: "_forward_auth", Value: "invalid"} },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newForwardedRequest("GET", "example.com", "/home")
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie(r))
+			}
+			w := httptest.NewRecorder()
+			s.RootHandler(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("IdentifyHandler() code = %v, want %v", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("X-Forwarded-User"); got != tt.wantUser {
+				t.Errorf("IdentifyHandler() X-Forwarded-User = %q, want %q", got, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestServer_rulePriority(t *testing.T) {
+	config := &Config{
+		DefaultAction: "deny",
+		Path:          "/_oauth",
+		Rules: map[string]*Rule{
+			"api": {
+				Action: "allow",
+				Rule:   "PathPrefix(`/api`)",
+			},
+			"api-admin": {
+				Action:   "deny",
+				Rule:     "PathPrefix(`/api/admin`)",
+				Priority: 10,
+			},
+			"a-admin": {
+				Action: "allow",
+				Rule:   "PathPrefix(`/admin`)",
+			},
+			"z-admin": {
+				Action: "deny",
+				Rule:   "PathPrefix(`/admin`)",
+			},
+		},
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		uri      string
+		wantCode int
+	}{
+		{
+			name:     "test higher priority matched first",
+			uri:      "/api/admin/users",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "test lower priority",
+			uri:      "/api/users",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "test equal priority matched by name",
+			uri:      "/admin",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "test default deny",
+			uri:      "/other",
+			wantCode: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.RootHandler(w, newForwardedRequest("GET", "example.com", tt.uri))
+			if w.Code != tt.wantCode {
+				t.Errorf("RootHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestServer_ruleMaxAuthAge(t *testing.T) {
+	config := &Config{
+		Path:            "/_oauth",
+		Secret:          []byte("secret"),
+		Lifetime:        time.Hour * 12,
+		CookieName:      "_forward_auth",
+		CSRFCookieName:  "_forward_auth_csrf",
+		UserInfoCookie:  "_user_info",
+		UserInfoFormat:  "json",
+		CookieHashKey:   "AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+		CookieBlockKey:  "R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+		DefaultAction:   "auth",
+		DefaultProvider: "oidc",
+		Rules: map[string]*Rule{
+			"payroll": {
+				Action:     "auth",
+				Rule:       "PathPrefix(`/payroll`)",
+				Provider:   "oidc",
+				MaxAuthAge: 900,
+			},
+		},
+		Providers: provider.Providers{
+			OIDC: provider.OIDC{
+				OAuthProvider: provider.OAuthProvider{
+					Config: &oauth2.Config{
+						Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"},
+					},
+				},
+			},
+		},
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		uri              string
+		authAge          time.Duration
+		noUserCookie     bool
+		reauthenticated  bool
+		wantCode         int
+		wantParams       url.Values
+		wantReauthCookie string
+	}{
+		{
+			name:     "test recent login",
+			uri:      "/payroll",
+			authAge:  time.Minute,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:             "test old login re-authenticates",
+			uri:              "/payroll",
+			authAge:          time.Hour,
+			wantCode:         http.StatusTemporaryRedirect,
+			wantParams:       url.Values{"prompt": {"login"}, "max_age": {"900"}},
+			wantReauthCookie: "payroll",
+		},
+		{
+			name:             "test unknown auth time re-authenticates",
+			uri:              "/payroll",
+			noUserCookie:     true,
+			wantCode:         http.StatusTemporaryRedirect,
+			wantParams:       url.Values{"prompt": {"login"}, "max_age": {"900"}},
+			wantReauthCookie: "payroll",
+		},
+		{
+			name:             "test old login after re-authenticating is forbidden",
+			uri:              "/payroll",
+			authAge:          time.Hour,
+			reauthenticated:  true,
+			wantCode:         http.StatusForbidden,
+			wantReauthCookie: "",
+		},
+		{
+			name:     "test other rules keep the session",
+			uri:      "/wiki",
+			authAge:  time.Hour,
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newForwardedRequest("GET", "example.com", tt.uri)
+			r.AddCookie(s.auth.MakeCookie(r, "test@example.com"))
+			if !tt.noUserCookie {
+				c, err := s.auth.MakeUserInfoCookie(r, provider.User{
+					Email:    "test@example.com",
+					AuthTime: time.Now().Add(-tt.authAge).Unix(),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.AddCookie(c)
+			}
+			if tt.reauthenticated {
+				r.AddCookie(s.auth.MakeReauthCookie(r, "payroll"))
+			}
+
+			w := httptest.NewRecorder()
+			s.RootHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("RootHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+
+			reauthCookie, set := "", false
+			for _, c := range w.Result().Cookies() {
+				if c.Name == "_forward_auth_csrf_reauth" {
+					reauthCookie, set = c.Value, true
+				}
+			}
+			if wantSet := tt.wantReauthCookie != "" || tt.reauthenticated; set != wantSet || reauthCookie != tt.wantReauthCookie {
+				t.Errorf("RootHandler() reauth cookie = %q (set %v), want %q", reauthCookie, set, tt.wantReauthCookie)
+			}
+
+			loc, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name := range tt.wantParams {
+				if got := loc.Query().Get(name); got != tt.wantParams.Get(name) {
+					t.Errorf("RootHandler() login url %s = %q, want %q", name, got, tt.wantParams.Get(name))
+				}
+			}
+		})
+	}
+}
+
+func TestServer_ruleStepUp(t *testing.T) {
+	config := &Config{
+		Path:            "/_oauth",
+		Secret:          []byte("secret"),
+		Lifetime:        time.Hour * 12,
+		CookieName:      "_forward_auth",
+		CSRFCookieName:  "_forward_auth_csrf",
+		UserInfoCookie:  "_user_info",
+		UserInfoFormat:  "json",
+		CookieHashKey:   "AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+		CookieBlockKey:  "R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+		DefaultAction:   "auth",
+		DefaultProvider: "oidc",
+		Rules: map[string]*Rule{
+			"payroll": {
+				Action:   "auth",
+				Rule:     "PathPrefix(`/payroll`)",
+				Provider: "oidc",
+				ACR:      []string{"urn:example:mfa", "urn:example:hwk"},
+			},
+			"admin": {
+				Action:   "auth",
+				Rule:     "PathPrefix(`/admin`)",
+				Provider: "oidc",
+				AMR:      []string{"otp"},
+			},
+		},
+		Providers: provider.Providers{
+			OIDC: provider.OIDC{
+				OAuthProvider: provider.OAuthProvider{
+					Config: &oauth2.Config{
+						Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"},
+					},
+				},
+			},
+		},
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		uri              string
+		acr              string
+		amr              []string
+		steppedUp        bool
+		wantCode         int
+		wantACR          string
+		wantStepUpCookie bool
+	}{
+		{
+			name:     "test acr accepted",
+			uri:      "/payroll",
+			acr:      "urn:example:hwk",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:             "test acr steps up",
+			uri:              "/payroll",
+			acr:              "urn:example:pwd",
+			wantCode:         http.StatusTemporaryRedirect,
+			wantACR:          "urn:example:mfa urn:example:hwk",
+			wantStepUpCookie: true,
+		},
+		{
+			name:      "test acr still not met after step up",
+			uri:       "/payroll",
+			acr:       "urn:example:pwd",
+			steppedUp: true,
+			wantCode:  http.StatusForbidden,
+		},
+		{
+			name:     "test amr included",
+			uri:      "/admin",
+			amr:      []string{"pwd", "otp"},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:             "test amr steps up",
+			uri:              "/admin",
+			amr:              []string{"pwd"},
+			wantCode:         http.StatusTemporaryRedirect,
+			wantStepUpCookie: true,
+		},
+		{
+			name:     "test rule without requirements",
+			uri:      "/wiki",
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newForwardedRequest("GET", "example.com", tt.uri)
+			r.AddCookie(s.auth.MakeCookie(r, "test@example.com"))
+			c, err := s.auth.MakeUserInfoCookie(r, provider.User{Email: "test@example.com", ACR: tt.acr, AMR: tt.amr})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.AddCookie(c)
+			if tt.steppedUp {
+				r.AddCookie(s.auth.MakeStepUpCookie(r, "payroll"))
+			}
+
+			w := httptest.NewRecorder()
+			s.RootHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("RootHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+
+			loc, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := loc.Query().Get("acr_values"); got != tt.wantACR {
+				t.Errorf("RootHandler() login url acr_values = %q, want %q", got, tt.wantACR)
+			}
+
+			var stepUpCookie bool
+			for _, c := range w.Result().Cookies() {
+				if c.Name == "_forward_auth_csrf_step_up" && c.Value != "" {
+					stepUpCookie = true
+				}
+			}
+			if stepUpCookie != tt.wantStepUpCookie {
+				t.Errorf("RootHandler() set step up cookie = %v, want %v", stepUpCookie, tt.wantStepUpCookie)
+			}
+		})
+	}
+}
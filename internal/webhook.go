@@ -0,0 +1,163 @@
+package tfa
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rajasoun/traefik-forward-auth/internal/provider"
+)
+
+// WebhookRequest is POSTed to a rule's webhook for each request a user is
+// otherwise permitted to make
+type WebhookRequest struct {
+	Rule    string           `json:"rule"`
+	User    provider.User    `json:"user"`
+	Request WebhookForwarded `json:"request"`
+}
+
+// WebhookForwarded describes the forwarded request
+type WebhookForwarded struct {
+	Method   string `json:"method"`
+	Proto    string `json:"proto"`
+	Host     string `json:"host"`
+	URI      string `json:"uri"`
+	ClientIP string `json:"client_ip"`
+}
+
+// WebhookResponse is the webhook's decision, with headers to add to the
+// response to traefik when the request is allowed
+type WebhookResponse struct {
+	Allow   bool              `json:"allow"`
+	Reason  string            `json:"reason,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// maxWebhookCacheEntries bounds the decision cache, expired decisions are
+// removed once it's reached
+const maxWebhookCacheEntries = 10000
+
+type webhookCacheEntry struct {
+	res     *WebhookResponse
+	expires time.Time
+}
+
+// webhooks calls the rules' webhooks, caching their decisions
+type webhooks struct {
+	client *http.Client
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]webhookCacheEntry
+}
+
+func newWebhooks(c *Config) *webhooks {
+	return &webhooks{
+		client: &http.Client{Timeout: time.Duration(c.WebhookTimeout) * time.Second},
+		ttl:    time.Duration(c.WebhookCacheTTL) * time.Second,
+		cache:  make(map[string]webhookCacheEntry),
+	}
+}
+
+// decide returns the webhook's decision for req, from the cache when the
+// same request was decided within the cache ttl
+func (wh *webhooks) decide(url string, req *WebhookRequest) (*WebhookResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(append([]byte(url+"\n"), body...))
+	key := hex.EncodeToString(sum[:])
+	if res, ok := wh.cached(key); ok {
+		return res, nil
+	}
+
+	r, err := wh.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	// Server errors are failures, left to the rule's failure mode, while
+	// other statuses, such as 401 and 403, are the webhook's denial
+	if r.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("%s: %s", url, r.Status)
+	}
+
+	res := &WebhookResponse{}
+	if r.StatusCode != http.StatusOK {
+		json.NewDecoder(r.Body).Decode(res)
+		res = &WebhookResponse{Allow: false, Reason: res.Reason}
+	} else if err := json.NewDecoder(r.Body).Decode(res); err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+
+	wh.store(key, res)
+	return res, nil
+}
+
+func (wh *webhooks) cached(key string) (*WebhookResponse, bool) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	entry, ok := wh.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.res, true
+}
+
+func (wh *webhooks) store(key string, res *WebhookResponse) {
+	if wh.ttl <= 0 {
+		return
+	}
+
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	now := time.Now()
+	if len(wh.cache) >= maxWebhookCacheEntries {
+		for k, entry := range wh.cache {
+			if now.After(entry.expires) {
+				delete(wh.cache, k)
+			}
+		}
+		if len(wh.cache) >= maxWebhookCacheEntries {
+			return
+		}
+	}
+	wh.cache[key] = webhookCacheEntry{res: res, expires: now.Add(wh.ttl)}
+}
+
+// webhookDecision asks the rule's webhook, if it has one, whether the user
+// authenticated as email may make the request, returning nil if there's no
+// webhook. If the webhook fails the error is returned along with a decision
+// made by the rule's failure mode
+func (s *Server) webhookDecision(rule string, r *http.Request, email string) (*WebhookResponse, error) {
+	rl, ok := s.config.Rules[rule]
+	if !ok || rl.Webhook == "" {
+		return nil, nil
+	}
+
+	res, err := s.webhooks.decide(rl.Webhook, &WebhookRequest{
+		Rule: rule,
+		User: s.sessionUser(r, email),
+		Request: WebhookForwarded{
+			Method:   r.Header.Get("X-Forwarded-Method"),
+			Proto:    r.Header.Get("X-Forwarded-Proto"),
+			Host:     r.Header.Get("X-Forwarded-Host"),
+			URI:      r.Header.Get("X-Forwarded-Uri"),
+			ClientIP: s.config.clientIP(r),
+		},
+	})
+	if err != nil {
+		return &WebhookResponse{Allow: rl.WebhookFailOpen}, err
+	}
+	return res, nil
+}
@@ -0,0 +1,305 @@
+package tfa
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rajasoun/traefik-forward-auth/internal/provider"
+	"golang.org/x/oauth2"
+)
+
+func TestServer_ruleWebhook(t *testing.T) {
+	var calls int32
+	entitlements := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch req.User.Email {
+		case "slow@example.com":
+			time.Sleep(200 * time.Millisecond)
+		case "broken@example.com":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case "unauthorized@example.com":
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case "forbidden@example.com":
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(WebhookResponse{Allow: true, Reason: "Account suspended."})
+			return
+		}
+
+		res := WebhookResponse{Allow: req.User.Email == "alice@example.com" && req.Request.Method == "GET"}
+		if res.Allow {
+			res.Headers = map[string]string{"X-Entitlements": "payroll:read", "X-Rule": req.Rule}
+		} else {
+			res.Reason = "No payroll entitlement."
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer entitlements.Close()
+
+	config := &Config{
+		Path:            "/_oauth",
+		Secret:          []byte("secret"),
+		Lifetime:        time.Hour,
+		CookieName:      "_forward_auth",
+		CSRFCookieName:  "_forward_auth_csrf",
+		UserInfoCookie:  "_user_info",
+		CookieHashKey:   "AMC7VVW06NF6NG1BN8WGQR4GGSHYHMKN",
+		CookieBlockKey:  "R78IRDN6920MJPE2RD7MFQ9Y2GN5AKTJ",
+		DefaultAction:   "auth",
+		DefaultProvider: "oidc",
+		WebhookCacheTTL: 60,
+		Rules: map[string]*Rule{
+			"payroll": {
+				Action:   "auth",
+				Rule:     "PathPrefix(`/payroll`)",
+				Provider: "oidc",
+				Webhook:  entitlements.URL,
+			},
+			"wiki": {
+				Action:          "auth",
+				Rule:            "PathPrefix(`/wiki`)",
+				Provider:        "oidc",
+				Webhook:         entitlements.URL,
+				WebhookFailOpen: true,
+			},
+		},
+		Providers: provider.Providers{
+			OIDC: provider.OIDC{
+				OAuthProvider: provider.OAuthProvider{
+					Config: &oauth2.Config{},
+				},
+			},
+		},
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.webhooks.client.Timeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name           string
+		method         string
+		uri            string
+		email          string
+		wantCode       int
+		wantHeader     string
+		wantReason     string
+		wantCalls      int32
+		wantRuleHeader string
+	}{
+		{
+			name:           "test allowed with headers",
+			method:         "GET",
+			uri:            "/payroll",
+			email:          "alice@example.com",
+			wantCode:       http.StatusOK,
+			wantHeader:     "payroll:read",
+			wantCalls:      1,
+			wantRuleHeader: "payroll",
+		},
+		{
+			name:           "test decision cached",
+			method:         "GET",
+			uri:            "/payroll",
+			email:          "alice@example.com",
+			wantCode:       http.StatusOK,
+			wantHeader:     "payroll:read",
+			wantCalls:      0,
+			wantRuleHeader: "payroll",
+		},
+		{
+			name:       "test denied with reason",
+			method:     "POST",
+			uri:        "/payroll",
+			email:      "alice@example.com",
+			wantCode:   http.StatusForbidden,
+			wantReason: "No payroll entitlement.",
+			wantCalls:  1,
+		},
+		{
+			name:      "test fail closed",
+			method:    "GET",
+			uri:       "/payroll",
+			email:     "broken@example.com",
+			wantCode:  http.StatusForbidden,
+			wantCalls: 1,
+		},
+		{
+			name:      "test failure not cached",
+			method:    "GET",
+			uri:       "/payroll",
+			email:     "broken@example.com",
+			wantCode:  http.StatusForbidden,
+			wantCalls: 1,
+		},
+		{
+			name:      "test fail open",
+			method:    "GET",
+			uri:       "/wiki",
+			email:     "broken@example.com",
+			wantCode:  http.StatusOK,
+			wantCalls: 1,
+		},
+		{
+			name:      "test unauthorized status denies when fail open",
+			method:    "GET",
+			uri:       "/wiki",
+			email:     "unauthorized@example.com",
+			wantCode:  http.StatusForbidden,
+			wantCalls: 1,
+		},
+		{
+			name:       "test forbidden status denies with reason when fail open",
+			method:     "GET",
+			uri:        "/wiki",
+			email:      "forbidden@example.com",
+			wantCode:   http.StatusForbidden,
+			wantReason: "Account suspended.",
+			wantCalls:  1,
+		},
+		{
+			name:      "test timeout",
+			method:    "GET",
+			uri:       "/payroll",
+			email:     "slow@example.com",
+			wantCode:  http.StatusForbidden,
+			wantCalls: 1,
+		},
+		{
+			name:      "test rule without webhook",
+			method:    "GET",
+			uri:       "/other",
+			email:     "bob@example.com",
+			wantCode:  http.StatusOK,
+			wantCalls: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			r := newForwardedRequest(tt.method, "example.com", tt.uri)
+			r.AddCookie(s.auth.MakeCookie(r, tt.email))
+
+			w := httptest.NewRecorder()
+			s.RootHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("RootHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("X-Entitlements"); got != tt.wantHeader {
+				t.Errorf("RootHandler() X-Entitlements = %q, want %q", got, tt.wantHeader)
+			}
+			if got := w.Header().Get("X-Rule"); got != tt.wantRuleHeader {
+				t.Errorf("RootHandler() X-Rule = %q, want %q", got, tt.wantRuleHeader)
+			}
+			if tt.wantReason != "" && !strings.Contains(w.Body.String(), tt.wantReason) {
+				t.Errorf("RootHandler() body = %q, want reason %q", w.Body.String(), tt.wantReason)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("webhook calls = %v, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestServer_Reload_webhooks(t *testing.T) {
+	var calls int32
+	allow := int32(1)
+	entitlements := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		json.NewEncoder(w).Encode(WebhookResponse{Allow: atomic.LoadInt32(&allow) == 1})
+	}))
+	defer entitlements.Close()
+
+	newConfig := func() *Config {
+		return &Config{
+			Path:            "/_oauth",
+			Secret:          []byte("secret"),
+			Lifetime:        time.Hour,
+			CookieName:      "_forward_auth",
+			CSRFCookieName:  "_forward_auth_csrf",
+			UserInfoCookie:  "_user_info",
+			DefaultAction:   "auth",
+			DefaultProvider: "oidc",
+			WebhookTimeout:  5,
+			WebhookCacheTTL: 60,
+			Rules: map[string]*Rule{
+				"payroll": {Action: "auth", Rule: "PathPrefix(`/payroll`)", Provider: "oidc", Webhook: entitlements.URL},
+			},
+			Providers: provider.Providers{
+				OIDC: provider.OIDC{
+					OAuthProvider: provider.OAuthProvider{Config: &oauth2.Config{}},
+				},
+			},
+		}
+	}
+	s, err := NewServer(newConfig(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func() int {
+		r := newForwardedRequest("GET", "example.com", "/payroll")
+		r.AddCookie(s.auth.MakeCookie(r, "alice@example.com"))
+		w := httptest.NewRecorder()
+		s.RootHandler(w, r)
+		return w.Code
+	}
+
+	if code := request(); code != http.StatusOK {
+		t.Fatalf("RootHandler() code = %v, want %v", code, http.StatusOK)
+	}
+
+	// The cached decision outlives the entitlement until the config is
+	// reloaded
+	atomic.StoreInt32(&allow, 0)
+	if code := request(); code != http.StatusOK {
+		t.Errorf("RootHandler() code = %v before reload, want cached %v", code, http.StatusOK)
+	}
+
+	reloaded := newConfig()
+	reloaded.WebhookTimeout = 1
+	if err := s.Reload(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if code := request(); code != http.StatusForbidden {
+		t.Errorf("RootHandler() code = %v after reload, want %v", code, http.StatusForbidden)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("webhook calls = %v, want %v", got, 2)
+	}
+	if got := s.active().webhooks.client.Timeout; got != time.Second {
+		t.Errorf("webhook timeout = %v after reload, want %v", got, time.Second)
+	}
+}
+
+func Test_webhooks_store(t *testing.T) {
+	wh := newWebhooks(&Config{})
+	wh.store("key", &WebhookResponse{Allow: true})
+	if _, ok := wh.cached("key"); ok {
+		t.Errorf("webhooks.cached() = true with caching disabled")
+	}
+
+	wh.ttl = time.Minute
+	wh.store("key", &WebhookResponse{Allow: true})
+	if res, ok := wh.cached("key"); !ok || !res.Allow {
+		t.Errorf("webhooks.cached() = %v, %v, want cached allow", res, ok)
+	}
+
+	wh.cache["key"] = webhookCacheEntry{res: &WebhookResponse{Allow: true}, expires: time.Now().Add(-time.Second)}
+	if _, ok := wh.cached("key"); ok {
+		t.Errorf("webhooks.cached() = true for an expired decision")
+	}
+}